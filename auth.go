@@ -0,0 +1,64 @@
+package tcpproto
+
+import (
+	"crypto/x509"
+)
+
+// Looks up the user a verified client certificate belongs to, nil for unknown certificates.
+type CertificateLookup func(cert *x509.Certificate) (*User, error)
+
+// Authenticator for CONF.Default_Auth, which sets rq.User from the client certificate.
+// The server must verify client certificates, see NewServerTLSConfig.
+// Requests without a verified certificate, or with a certificate the lookup does not know,
+// are answered with STATUS_UNAUTHORIZED.
+func CertificateAuth(lookup CertificateLookup) func(rq *Request, resp *Response) error {
+	return func(rq *Request, resp *Response) error {
+		if rq.TLS == nil || len(rq.TLS.VerifiedChains) == 0 {
+			return NewStatusError(STATUS_UNAUTHORIZED, "no verified client certificate")
+		}
+		user, err := lookup(rq.PeerCertificate())
+		if err != nil {
+			CONF.LOGGER.Error("error looking up client certificate: " + err.Error())
+			return NewStatusError(STATUS_INTERNAL_ERROR, "error looking up client certificate")
+		}
+		if user == nil {
+			return NewStatusError(STATUS_UNAUTHORIZED, "unknown client certificate")
+		}
+		// The lookup may return the same user for every request
+		authenticated := *user
+		authenticated.IsAuthenticated = true
+		rq.User = &authenticated
+		return nil
+	}
+}
+
+// The names a certificate was issued for, the subject alternative names
+// (URIs, DNS names, email addresses and IP addresses) followed by the common name of the subject.
+func CertificateIdentities(cert *x509.Certificate) []string {
+	identities := make([]string, 0)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		identities = append(identities, ip.String())
+	}
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	return identities
+}
+
+// Lookup for CertificateAuth, which finds the user by the identities of the certificate,
+// in the order of CertificateIdentities.
+func UsersByCertificate(users map[string]*User) CertificateLookup {
+	return func(cert *x509.Certificate) (*User, error) {
+		for _, identity := range CertificateIdentities(cert) {
+			if user, ok := users[identity]; ok {
+				return user, nil
+			}
+		}
+		return nil, nil
+	}
+}
@@ -0,0 +1,69 @@
+package tcpproto
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func Test_CertificateAuth(t *testing.T) {
+	testConfig(t, func(conf *Config) {
+		conf.Default_Auth = CertificateAuth(UsersByCertificate(map[string]*User{
+			"spiffe://fleet/agent-1": {ID: 1, Username: "agent-1"},
+		}))
+	})
+
+	dir := t.TempDir()
+	ca, ca_key := writeTestCert(t, dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, ca_key)
+	agent_uri, _ := url.Parse("spiffe://fleet/agent-1")
+	writeTestCert(t, dir, "agent-1", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "agent"},
+		URIs:        []*url.URL{agent_uri},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, ca_key)
+	writeTestCert(t, dir, "agent-2", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "agent"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, ca_key)
+
+	pool, _ := LoadCertPool(filepath.Join(dir, "ca.pem"))
+	server := InitServer("127.0.0.1", 0, "")
+	server.TLSConfig, _ = NewServerTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), pool)
+	server.AddCallback("WHOAMI", func(rq *Request, resp *Response) {
+		if rq.User.IsAuthenticated {
+			resp.Content = []byte(rq.User.Username)
+		}
+	})
+	startTestServer(t, server)
+
+	connect := func(name string) *Client {
+		return connectTestClient(t, server, func(client *Client) {
+			client.TLSConfig, _ = NewClientTLSConfig(pool, filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key"))
+		})
+	}
+
+	known := connect("agent-1")
+	resp, err := known.Send(InitRequest("WHOAMI"))
+	if err != nil || string(resp.Content) != "agent-1" {
+		t.Errorf("Client certificate was not mapped to its user: %v %q", err, resp.Content)
+	}
+
+	unknown := connect("agent-2")
+	resp, err = unknown.Send(InitRequest("WHOAMI"))
+	if err != nil || resp.Status() != STATUS_UNAUTHORIZED {
+		t.Errorf("Unknown client certificate was not refused: %v %q", err, resp.Content)
+	}
+}
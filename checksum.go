@@ -0,0 +1,106 @@
+package tcpproto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+)
+
+// Returned when a CONTENT_CHECKSUM or FILE_CHECKSUM does not match the received data.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var crc32c_table = crc32.MakeTable(crc32.Castagnoli)
+
+// Supported checksum algorithms in order of preference.
+var checksum_algorithms = []string{"crc32c", "sha256"}
+
+// Create a new hash for the checksum algorithm.
+// This can be used to checksum streamed data, and send the result as a trailer.
+func NewChecksum(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "crc32c":
+		return crc32.New(crc32c_table), nil
+	case "sha256":
+		return sha256.New(), nil
+	}
+	return nil, errors.New("unsupported checksum algorithm: " + algorithm)
+}
+
+// The value for the ACCEPT_CHECKSUM header.
+func AcceptChecksum() string {
+	return strings.Join(checksum_algorithms, ",")
+}
+
+// Pick the first algorithm from an ACCEPT_CHECKSUM header which is supported.
+func NegotiateChecksum(accept string) (string, bool) {
+	for _, algorithm := range strings.Split(accept, ",") {
+		algorithm = strings.TrimSpace(algorithm)
+		for _, supported := range checksum_algorithms {
+			if algorithm == supported {
+				return algorithm, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Calculate the checksum header value for the data, formatted as algorithm=hex.
+func Checksum(algorithm string, data []byte) (string, error) {
+	h, err := NewChecksum(algorithm)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return algorithm + "=" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify data against a checksum header value formatted as algorithm=hex.
+func VerifyChecksum(checksum string, data []byte) error {
+	algorithm, _, ok := strings.Cut(checksum, "=")
+	if !ok {
+		return errors.New("invalid checksum: " + checksum)
+	}
+	expected, err := Checksum(algorithm, data)
+	if err != nil {
+		return err
+	}
+	if expected != checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// Replace a checksum header holding only an algorithm with the checksum of the data.
+func setChecksum(headers map[string]string, key string, data []byte) error {
+	algorithm := headers[key]
+	if strings.Contains(algorithm, "=") {
+		// Already calculated, compute again in case the data changed
+		algorithm, _, _ = strings.Cut(algorithm, "=")
+	}
+	checksum, err := Checksum(algorithm, data)
+	if err != nil {
+		return err
+	}
+	headers[key] = checksum
+	return nil
+}
+
+// Verify the data against the checksum header if one is present.
+func verifyChecksumHeader(headers map[string]string, key string, data []byte) error {
+	checksum, ok := headers[key]
+	if !ok {
+		return nil
+	}
+	err := VerifyChecksum(checksum, data)
+	if err != nil {
+		if err == ErrChecksumMismatch {
+			return fmt.Errorf("%w: %s", ErrChecksumMismatch, key)
+		}
+		return err
+	}
+	return nil
+}
@@ -1,31 +1,77 @@
 package tcpproto
 
 import (
+	"bufio"
+	"context"
 	"crypto/rsa"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"net"
 	"strconv"
+	"sync"
 )
 
 type Client struct {
-	IP          string
-	Port        int
-	Conn        net.Conn
-	Cookies     map[string]*Cookie
+	IP      string
+	Port    int
+	Conn    net.Conn
+	reader  *bufio.Reader
+	Cookies *Cookies
+	// Stores the cookies, so they can be shared with other clients and kept across restarts
+	Jar         CookieJar
 	ClientVault map[string]string
 	PUBKEY      *rsa.PublicKey
+	// Connect with TLS when set, see NewClientTLSConfig.
+	TLSConfig *tls.Config
+	// Encrypt the connection with the secure handshake, the server is verified with PUBKEY.
+	Secure bool
+	// Default content type for Call, CONF.Content_Type is used when empty.
+	ContentType string
+	// Protocol version and features agreed upon in the handshake,
+	// and the features the server declined.
+	Version  int
+	Features []string
+	Declined []string
+	// Responses are read by a single goroutine, which also dispatches pushes.
+	write_mu      sync.Mutex
+	pending_mu    sync.Mutex
+	pending       map[string]chan *frame
+	pending_order []string
+	next_id       uint64
+	reading       bool
+	read_err      error
+	push_handlers map[string]func(msg *Response)
+	// Pushes received during the handshakes, handed to the push handlers once the read loop starts.
+	early_pushes  []*Response
+	subscriptions map[string]func(msg *Response)
+	streams       map[string]*Stream
+}
+
+// A frame read from the connection, or the error which stopped the reading.
+type frame struct {
+	header  map[string]string
+	content []byte
+	err     error
 }
 
 func (c *Client) Addr() string {
 	return c.IP + ":" + strconv.Itoa(c.Port)
 }
 
+func (c *Client) contentType() string {
+	if c.ContentType != "" {
+		return c.ContentType
+	}
+	return CONF.Content_Type
+}
+
 func InitClient(ip string, port int, pubkey_file string) *Client {
 	client := &Client{
 		IP:          ip,
 		Port:        port,
-		Cookies:     map[string]*Cookie{},
+		Cookies:     InitCookies(),
+		Jar:         NewMemoryJar(),
 		ClientVault: map[string]string{},
 		PUBKEY:      nil,
 	}
@@ -46,10 +92,37 @@ func (c *Client) Vault(key string, value string) error {
 
 func (c *Client) Connect() error {
 	var err error
-	c.Conn, err = net.Dial("tcp", c.Addr())
+	if c.TLSConfig != nil {
+		c.Conn, err = tls.Dial("tcp", c.Addr(), c.TLSConfig)
+	} else {
+		c.Conn, err = net.Dial("tcp", c.Addr())
+	}
 	if err != nil {
 		return err
 	}
+	c.pending_mu.Lock()
+	c.reader = bufio.NewReaderSize(c.Conn, CONF.BUFF_SIZE)
+	c.reading = false
+	c.read_err = nil
+	c.early_pushes = nil
+	c.pending_mu.Unlock()
+	if c.Secure {
+		err = c.secureHandshake()
+		if err != nil {
+			c.Conn.Close()
+			return err
+		}
+	}
+	// Features of a previous connection do not carry over
+	c.Version, c.Features, c.Declined = 0, nil, nil
+	if CONF.Use_Handshake {
+		err = c.Handshake()
+		if err != nil {
+			c.Conn.Close()
+			return err
+		}
+	}
+	c.startReading()
 	return nil
 }
 
@@ -58,8 +131,21 @@ func (c *Client) Close() error {
 }
 
 func (c *Client) Send(rq *Request) (*Response, error) {
-	for key, val := range c.Cookies {
-		rq.AddCookie(key, val.Value)
+	return c.SendContext(context.Background(), rq)
+}
+
+// Send the request, and stop waiting for the response when the context is done.
+// A response which arrives later is dropped.
+func (c *Client) SendContext(ctx context.Context, rq *Request) (*Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	err := c.syncJar()
+	if err != nil {
+		CONF.LOGGER.Error("error reading cookie jar: " + err.Error())
+	}
+	for _, cookie := range c.Cookies.ForCommand(rq.Headers["COMMAND"]) {
+		rq.AddCookie(cookie.Name, cookie.Value)
 	}
 
 	if CONF.Use_Crypto {
@@ -76,17 +162,32 @@ func (c *Client) Send(rq *Request) (*Response, error) {
 		}
 	}
 
+	if c.Version != 0 {
+		rq.Headers["PROTO_VERSION"] = strconv.Itoa(c.Version)
+	}
+
+	if CONF.Use_Compression && c.HasFeature(FEATURE_COMPRESSION) {
+		if _, ok := rq.Headers["ACCEPT_ENCODING"]; !ok {
+			rq.Headers["ACCEPT_ENCODING"] = AcceptEncoding()
+		}
+	}
+
+	if CONF.Checksum != "" && c.HasFeature(FEATURE_CHECKSUM) {
+		if _, ok := rq.Headers["ACCEPT_CHECKSUM"]; !ok {
+			rq.Headers["ACCEPT_CHECKSUM"] = CONF.Checksum + "," + AcceptChecksum()
+		}
+		if _, ok := rq.Headers["CONTENT_CHECKSUM"]; !ok {
+			rq.Headers["CONTENT_CHECKSUM"] = CONF.Checksum
+		}
+	}
+
 	if CONF.Include_Sysinfo {
 		sysinfo := GetSysInfo()
 		rq.Headers["SYSINFO"] = sysinfo.ToJSON()
 	}
 
 	// Send the request
-	err := c.send(rq)
-	if err != nil {
-		return nil, err
-	}
-	header, recv_data, err := c.recv_data()
+	header, recv_data, err := c.roundTrip(ctx, rq)
 	if err != nil {
 		return nil, err
 	}
@@ -106,11 +207,12 @@ func (c *Client) ParseResponse(rq *Request, header map[string]string, recv_data
 	if err != nil {
 		return nil, err
 	}
-	c.UpdateCookies(remember, forget)
+	c.updateCookies(remember, resp.Cookies, forget)
 	// Set the content
 	resp.Content = recv_data
-	// Parse possible included files
-	err = rq.ParseFile()
+	resp.content_type = c.contentType()
+	// Decode the message, this parses possible included files
+	err = resp.decode()
 	if err != nil {
 		return nil, err
 	}
@@ -118,37 +220,60 @@ func (c *Client) ParseResponse(rq *Request, header map[string]string, recv_data
 }
 
 func (c *Client) UpdateCookies(remember map[string]string, forget []string) {
+	c.updateCookies(remember, nil, forget)
+}
+
+// Update the cookies, attributes holds the cookies which were sent with attributes.
+func (c *Client) updateCookies(remember map[string]string, attributes map[string]*Cookie, forget []string) {
 	// Set client cookies
 	for key, val := range remember {
-		c.Cookies[key] = InitCookie(key, val)
+		cookie, ok := attributes[key]
+		if !ok {
+			// Cookies sent back unchanged keep their attributes
+			if existing := c.Cookies.GetCookie(key); existing != nil && existing.Value == val {
+				continue
+			}
+			cookie = InitCookie(key, val)
+		}
+		cookie.received()
+		if cookie.Expired() {
+			c.deleteCookie(key)
+			continue
+		}
+		c.Cookies.AddCookie(cookie)
+		if c.Jar != nil {
+			err := c.Jar.SetCookie(c.Addr(), cookie)
+			if err != nil {
+				CONF.LOGGER.Error("error storing cookie: " + err.Error())
+				continue
+			}
+			c.Cookies.setSynced(cookie)
+		}
 	}
 	// Remove client cookies
 	for _, key := range forget {
-		delete(c.Cookies, key)
+		c.deleteCookie(key)
 	}
+}
 
+func (c *Client) deleteCookie(key string) {
+	c.Cookies.DeleteCookie(key)
+	if c.Jar != nil {
+		err := c.Jar.DeleteCookie(c.Addr(), key)
+		if err != nil {
+			CONF.LOGGER.Error("error deleting cookie: " + err.Error())
+			return
+		}
+		c.Cookies.deleteSynced(key)
+	}
 }
 
 func (c *Client) recv_data() (map[string]string, []byte, error) {
-	// Receive response
-	buf, err := getHeader(c.Conn)
-	if err != nil {
-		return nil, nil, err
+	if c.reader == nil {
+		c.reader = bufio.NewReaderSize(c.Conn, CONF.BUFF_SIZE)
 	}
-	// Parse response
-	header, recv_data, err := parseHeader(buf)
-	if err != nil {
-		return nil, nil, err
-	}
-	// Get the content length
-	content_length, err := strconv.Atoi(header["CONTENT_LENGTH"])
-	if err != nil {
-		err = errors.New("invalid content length")
-		CONF.LOGGER.Error(err.Error())
-		return nil, nil, err
-	}
-	// Get the rest of content
-	recv_data, err = getContent(c.Conn, recv_data, content_length)
+	// Receive response
+	header, recv_data, err := readFrame(c.reader)
 	if err != nil {
 		CONF.LOGGER.Error(err.Error())
 		return nil, nil, err
@@ -163,9 +288,200 @@ func (c *Client) send(rq *Request) error {
 		return err
 	}
 	// Write to server
-	_, err = c.Conn.Write(content)
+	return c.writeFrame(content)
+}
+
+// Write a complete frame to the server,
+// writes are serialized so requests and streams can share the connection.
+func (c *Client) writeFrame(frame []byte) error {
+	c.write_mu.Lock()
+	defer c.write_mu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Send the request and wait for the response to it, or until the context is done.
+// Before the read loop has started, the response is read directly from the connection.
+func (c *Client) roundTrip(ctx context.Context, rq *Request) (map[string]string, []byte, error) {
+	c.pending_mu.Lock()
+	if !c.reading {
+		c.pending_mu.Unlock()
+		err := c.send(rq)
+		if err != nil {
+			return nil, nil, err
+		}
+		return c.recvReply()
+	}
+	if c.read_err != nil {
+		err := c.read_err
+		c.pending_mu.Unlock()
+		return nil, nil, err
+	}
+	c.next_id++
+	id := strconv.FormatUint(c.next_id, 10)
+	rq.Headers["REQUEST_ID"] = id
+	ch := make(chan *frame, 1)
+	c.pending[id] = ch
+	c.pending_order = append(c.pending_order, id)
+	c.pending_mu.Unlock()
+
+	err := c.send(rq)
 	if err != nil {
-		return err
+		c.pending_mu.Lock()
+		c.removePending(id)
+		c.pending_mu.Unlock()
+		return nil, nil, err
 	}
-	return nil
+	select {
+	case f := <-ch:
+		return f.header, f.content, f.err
+	case <-ctx.Done():
+		// The request stays pending, so responses without an ID still go to the right request.
+		// Its channel is buffered, the response is dropped when it arrives.
+		return nil, nil, ctx.Err()
+	}
+}
+
+// Read the reply to a request sent before the read loop has started.
+// Pushes which arrive first are kept for the push handlers, and must not be taken for the reply.
+func (c *Client) recvReply() (map[string]string, []byte, error) {
+	for {
+		header, recv_data, err := c.recv_data()
+		if err != nil {
+			return nil, nil, err
+		}
+		if header["MESSAGE_TYPE"] == MESSAGE_TYPE_PUSH {
+			msg, err := c.parsePush(header, recv_data)
+			if err != nil {
+				CONF.LOGGER.Error("error decoding push: " + err.Error())
+				continue
+			}
+			c.pending_mu.Lock()
+			c.early_pushes = append(c.early_pushes, msg)
+			c.pending_mu.Unlock()
+			continue
+		}
+		if isStreamFrame(header["MESSAGE_TYPE"]) {
+			// No streams are open before the read loop has started
+			CONF.LOGGER.Debug("Dropping stream frame received before the read loop: " + header["STREAM_ID"])
+			continue
+		}
+		return header, recv_data, nil
+	}
+}
+
+// Start reading responses and pushes from the connection.
+func (c *Client) startReading() {
+	c.pending_mu.Lock()
+	defer c.pending_mu.Unlock()
+	if c.reading {
+		return
+	}
+	c.reading = true
+	c.pending = make(map[string]chan *frame)
+	c.pending_order = nil
+	pushes := make(chan *Response, CONF.PUSH_BUFFER_SIZE)
+	for _, msg := range c.early_pushes {
+		select {
+		case pushes <- msg:
+		default:
+			CONF.LOGGER.Error("push buffer full, dropping push: " + msg.Headers["COMMAND"])
+		}
+	}
+	c.early_pushes = nil
+	go c.handlePushes(pushes)
+	go c.readLoop(c.reader, pushes)
+}
+
+func (c *Client) readLoop(reader *bufio.Reader, pushes chan *Response) {
+	defer close(pushes)
+	for {
+		header, recv_data, err := readFrame(reader)
+		if err != nil {
+			if c.failPending(reader, err) {
+				c.abortStreams(err)
+			}
+			return
+		}
+		if header["MESSAGE_TYPE"] == MESSAGE_TYPE_PUSH {
+			msg, err := c.parsePush(header, recv_data)
+			if err != nil {
+				CONF.LOGGER.Error("error decoding push: " + err.Error())
+				continue
+			}
+			// Slow push handlers must not hold up the responses
+			select {
+			case pushes <- msg:
+			default:
+				CONF.LOGGER.Error("push buffer full, dropping push: " + msg.Headers["COMMAND"])
+			}
+			continue
+		}
+		if isStreamFrame(header["MESSAGE_TYPE"]) {
+			c.deliverStream(header, recv_data)
+			continue
+		}
+		c.deliver(&frame{header: header, content: recv_data})
+	}
+}
+
+// Decode a pushed message. Pushes do not change the cookies of the client.
+func (c *Client) parsePush(header map[string]string, recv_data []byte) (*Response, error) {
+	msg := InitResponse()
+	_, _, err := msg.DecodeHeaders(header)
+	if err != nil {
+		return nil, err
+	}
+	msg.Content = recv_data
+	msg.content_type = c.contentType()
+	err = msg.decode()
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Hand a response to the request with the same REQUEST_ID.
+// Servers which do not echo the ID answer in order, so those go to the oldest request.
+func (c *Client) deliver(f *frame) {
+	c.pending_mu.Lock()
+	defer c.pending_mu.Unlock()
+	id, ok := f.header["REQUEST_ID"]
+	if !ok && len(c.pending_order) > 0 {
+		id = c.pending_order[0]
+	}
+	ch, ok := c.pending[id]
+	if !ok {
+		CONF.LOGGER.Debug("Received a response without a request: " + id)
+		return
+	}
+	c.removePending(id)
+	ch <- f
+}
+
+func (c *Client) removePending(id string) {
+	delete(c.pending, id)
+	for i, pending_id := range c.pending_order {
+		if pending_id == id {
+			c.pending_order = append(c.pending_order[:i], c.pending_order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Fail every waiting request, the connection can no longer be read.
+// Returns false if the client has reconnected since.
+func (c *Client) failPending(reader *bufio.Reader, err error) bool {
+	c.pending_mu.Lock()
+	defer c.pending_mu.Unlock()
+	if c.reader != reader {
+		return false
+	}
+	c.read_err = err
+	for id, ch := range c.pending {
+		ch <- &frame{err: err}
+		delete(c.pending, id)
+	}
+	c.pending_order = nil
+	return true
 }
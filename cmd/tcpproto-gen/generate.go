@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+type Schema struct {
+	Source  string
+	Package string
+	// Imports of the schema used by the request and response types
+	StdImports []string
+	Imports    []string
+	Services   []*Service
+	Errors     []*SchemaError
+}
+
+type Service struct {
+	Interface string
+	Name      string
+	Methods   []*Method
+}
+
+type Method struct {
+	Name     string
+	Request  string
+	Response string
+}
+
+type SchemaError struct {
+	Name    string
+	Status  int
+	Message string
+}
+
+// Generate the servers and clients for the services in the schema source.
+func Generate(filename string, src []byte) ([]byte, error) {
+	schema, err := ParseSchema(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, schema)
+	if err != nil {
+		return nil, err
+	}
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, errors.New("error formatting generated code: " + err.Error())
+	}
+	return formatted, nil
+}
+
+// Parse the services marked with a tcpproto:service directive out of the schema.
+func ParseSchema(filename string, src []byte) (*Schema, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	schema := &Schema{
+		Source:  path.Base(filename),
+		Package: file.Name.Name,
+	}
+	used_packages := make(map[string]bool)
+	error_names := make(map[string]bool)
+
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			type_spec := spec.(*ast.TypeSpec)
+			iface, ok := type_spec.Type.(*ast.InterfaceType)
+			if !ok {
+				continue
+			}
+			doc := type_spec.Doc
+			if doc == nil && len(gen.Specs) == 1 {
+				doc = gen.Doc
+			}
+			name, errs, ok, err := parseDirectives(doc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", type_spec.Name.Name, err)
+			}
+			if !ok {
+				continue
+			}
+			if name == "" {
+				name = strings.TrimSuffix(type_spec.Name.Name, "Service")
+			}
+			for _, schema_err := range errs {
+				if error_names[schema_err.Name] {
+					return nil, errors.New("error " + schema_err.Name + " is declared twice")
+				}
+				error_names[schema_err.Name] = true
+				schema.Errors = append(schema.Errors, schema_err)
+			}
+			service := &Service{
+				Interface: type_spec.Name.Name,
+				Name:      name,
+			}
+			for _, field := range iface.Methods.List {
+				if len(field.Names) == 0 {
+					return nil, errors.New(service.Interface + ": embedded interfaces are not supported")
+				}
+				method, err := parseMethod(fset, field, used_packages)
+				if err != nil {
+					return nil, fmt.Errorf("%s.%s: %w", service.Interface, field.Names[0].Name, err)
+				}
+				service.Methods = append(service.Methods, method)
+			}
+			schema.Services = append(schema.Services, service)
+		}
+	}
+	if len(schema.Services) == 0 {
+		return nil, errors.New("no services found, mark interfaces with //tcpproto:service")
+	}
+
+	// Keep the imports of the schema which are used by the request and response types
+	for _, imp := range file.Imports {
+		import_path, _ := strconv.Unquote(imp.Path.Value)
+		if import_path == "context" || import_path == "github.com/Nigel2392/tcpproto" {
+			continue
+		}
+		name := path.Base(import_path)
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		if !used_packages[name] {
+			continue
+		}
+		spec := imp.Path.Value
+		if imp.Name != nil {
+			spec = imp.Name.Name + " " + spec
+		}
+		// Standard library imports have no dot in their first element
+		if !strings.Contains(strings.Split(import_path, "/")[0], ".") {
+			schema.StdImports = append(schema.StdImports, spec)
+		} else {
+			schema.Imports = append(schema.Imports, spec)
+		}
+	}
+	return schema, nil
+}
+
+// Parse the tcpproto directives of an interface.
+// Returns the service name, its errors, and whether the interface is a service.
+func parseDirectives(doc *ast.CommentGroup) (string, []*SchemaError, bool, error) {
+	if doc == nil {
+		return "", nil, false, nil
+	}
+	var name string
+	var errs []*SchemaError
+	is_service := false
+	for _, comment := range doc.List {
+		text := strings.TrimPrefix(comment.Text, "//")
+		if directive, ok := cutPrefix(text, "tcpproto:service"); ok {
+			is_service = true
+			name = strings.TrimSpace(directive)
+		} else if directive, ok := cutPrefix(text, "tcpproto:error"); ok {
+			// tcpproto:error Name Status Message
+			fields := strings.Fields(directive)
+			if len(fields) < 3 {
+				return "", nil, false, errors.New("invalid error directive, expected: //tcpproto:error Name Status Message")
+			}
+			status, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return "", nil, false, errors.New("invalid status for error " + fields[0] + ": " + fields[1])
+			}
+			errs = append(errs, &SchemaError{
+				Name:    fields[0],
+				Status:  status,
+				Message: strings.Join(fields[2:], " "),
+			})
+		}
+	}
+	if !is_service && len(errs) > 0 {
+		return "", nil, false, errors.New("error directives without a service directive")
+	}
+	return name, errs, is_service, nil
+}
+
+func cutPrefix(s string, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// Verify the method looks like func(context.Context, Request) (Response, error).
+func parseMethod(fset *token.FileSet, field *ast.Field, used_packages map[string]bool) (*Method, error) {
+	fn := field.Type.(*ast.FuncType)
+	params := flattenFields(fn.Params)
+	results := flattenFields(fn.Results)
+	if len(params) != 2 || len(results) != 2 {
+		return nil, errors.New("methods need to look like func(ctx context.Context, args *Args) (*Reply, error)")
+	}
+	if exprString(fset, params[0]) != "context.Context" {
+		return nil, errors.New("the first parameter needs to be a context.Context")
+	}
+	if exprString(fset, results[1]) != "error" {
+		return nil, errors.New("the last result needs to be an error")
+	}
+	collectPackages(params[1], used_packages)
+	collectPackages(results[0], used_packages)
+	return &Method{
+		Name:     field.Names[0].Name,
+		Request:  exprString(fset, params[1]),
+		Response: exprString(fset, results[0]),
+	}, nil
+}
+
+// The types of a field list, with a type repeated for every name sharing it.
+func flattenFields(fields *ast.FieldList) []ast.Expr {
+	types := make([]ast.Expr, 0)
+	if fields == nil {
+		return types
+	}
+	for _, field := range fields.List {
+		if len(field.Names) == 0 {
+			types = append(types, field.Type)
+			continue
+		}
+		for range field.Names {
+			types = append(types, field.Type)
+		}
+	}
+	return types
+}
+
+func collectPackages(expr ast.Expr, used_packages map[string]bool) {
+	ast.Inspect(expr, func(node ast.Node) bool {
+		if sel, ok := node.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok {
+				used_packages[ident.Name] = true
+			}
+		}
+		return true
+	})
+}
+
+func exprString(fset *token.FileSet, expr ast.Expr) string {
+	buf := &bytes.Buffer{}
+	printer.Fprint(buf, fset, expr)
+	return buf.String()
+}
+
+var tmpl = template.Must(template.New("tcpproto").Parse(`// Code generated by tcpproto-gen from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+{{- range .StdImports}}
+	{{.}}
+{{- end}}
+
+	"github.com/Nigel2392/tcpproto"
+{{- range .Imports}}
+	{{.}}
+{{- end}}
+)
+{{if .Errors}}
+// Errors returned by the services, compare them with errors.Is.
+var (
+{{- range .Errors}}
+	{{.Name}} = tcpproto.NewStatusError({{.Status}}, {{printf "%q" .Message}})
+{{- end}}
+)
+{{end}}
+{{- range .Services}}
+{{- $service := .}}
+// Commands of the {{.Name}} service.
+const (
+{{- range .Methods}}
+	{{$service.Interface}}_{{.Name}} = "{{$service.Name}}.{{.Name}}"
+{{- end}}
+)
+
+// Register{{.Interface}} registers every method of impl as a command on the server.
+func Register{{.Interface}}(srv *tcpproto.Server, impl {{.Interface}}) {
+{{- range .Methods}}
+	tcpproto.Handle(srv, {{$service.Interface}}_{{.Name}}, impl.{{.Name}})
+{{- end}}
+}
+
+// {{.Interface}}Client calls the {{.Name}} service on the server the client is connected to.
+type {{.Interface}}Client struct {
+	Client *tcpproto.Client
+}
+
+var _ {{.Interface}} = (*{{.Interface}}Client)(nil)
+
+func New{{.Interface}}Client(client *tcpproto.Client) *{{.Interface}}Client {
+	return &{{.Interface}}Client{
+		Client: client,
+	}
+}
+{{range .Methods}}
+// {{.Name}} calls {{$service.Name}}.{{.Name}} on the server.
+func (c *{{$service.Interface}}Client) {{.Name}}(ctx context.Context, args {{.Request}}) ({{.Response}}, error) {
+	return tcpproto.CallContext[{{.Request}}, {{.Response}}](ctx, c.Client, {{$service.Interface}}_{{.Name}}, args)
+}
+{{end}}
+{{- end}}`))
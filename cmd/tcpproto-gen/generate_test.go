@@ -0,0 +1,103 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const test_schema = `package users
+
+import (
+	"context"
+	"time"
+)
+
+type CreateArgs struct {
+	Name string
+}
+
+type CreateReply struct {
+	ID      int
+	Created time.Time
+}
+
+//tcpproto:service Users
+//tcpproto:error ErrUserExists 409 user already exists
+type UserService interface {
+	Create(ctx context.Context, args *CreateArgs) (*CreateReply, error)
+	Ping(ctx context.Context, msg string) (string, error)
+}
+
+type NotAService interface {
+	Other() error
+}
+`
+
+func Test_Generate(t *testing.T) {
+	generated, err := Generate("users.go", []byte(test_schema))
+	if err != nil {
+		t.Fatal("error generating: " + err.Error())
+	}
+	_, err = parser.ParseFile(token.NewFileSet(), "users_tcpproto.go", generated, 0)
+	if err != nil {
+		t.Fatal("generated code does not parse: " + err.Error())
+	}
+	code := string(generated)
+	for _, expected := range []string{
+		`UserService_Create = "Users.Create"`,
+		`UserService_Ping   = "Users.Ping"`,
+		`ErrUserExists = tcpproto.NewStatusError(409, "user already exists")`,
+		`func RegisterUserService(srv *tcpproto.Server, impl UserService)`,
+		`tcpproto.Handle(srv, UserService_Create, impl.Create)`,
+		`func (c *UserServiceClient) Create(ctx context.Context, args *CreateArgs) (*CreateReply, error)`,
+		`tcpproto.CallContext[*CreateArgs, *CreateReply](ctx, c.Client, UserService_Create, args)`,
+	} {
+		if !strings.Contains(code, expected) {
+			t.Error("Generated code does not contain: " + expected)
+		}
+	}
+	if strings.Contains(code, "NotAService") {
+		t.Error("Interface without directive was generated")
+	}
+	if strings.Contains(code, `"time"`) {
+		t.Error("Unused import was kept")
+	}
+}
+
+// Build the generated code together with the schema, against this module.
+func Test_Generate_Build(t *testing.T) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	generated, err := Generate("users.go", []byte(test_schema))
+	if err != nil {
+		t.Fatal("error generating: " + err.Error())
+	}
+	// The package needs to be inside the module to import tcpproto,
+	// directories starting with an underscore are ignored by ./...
+	dir, err := os.MkdirTemp(".", "_build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.WriteFile(filepath.Join(dir, "users.go"), []byte(test_schema), 0644)
+	os.WriteFile(filepath.Join(dir, "users_tcpproto.go"), generated, 0644)
+	output, err := exec.Command(gobin, "vet", "./"+filepath.Base(dir)).CombinedOutput()
+	if err != nil {
+		t.Fatal("generated code does not build: " + err.Error() + "\n" + string(output))
+	}
+}
+
+func Test_Generate_InvalidMethod(t *testing.T) {
+	schema := strings.Replace(test_schema, "Ping(ctx context.Context, msg string) (string, error)", "Ping(msg string) string", 1)
+	_, err := Generate("users.go", []byte(schema))
+	if err == nil {
+		t.Error("Invalid method was not rejected")
+	}
+}
@@ -0,0 +1,67 @@
+// Command tcpproto-gen generates typed servers and clients from a service schema.
+//
+// The schema is a Go file in the package the code is generated for.
+// Interfaces marked with a tcpproto:service directive are services,
+// each method is a command named "Service.Method":
+//
+//	package users
+//
+//	//tcpproto:service Users
+//	//tcpproto:error ErrUserExists 409 user already exists
+//	type UserService interface {
+//		Create(ctx context.Context, args *CreateArgs) (*CreateReply, error)
+//	}
+//
+// Methods need to take a context.Context and the request type, and return the response type and an error.
+// Errors are generated as *tcpproto.StatusError variables, which can be compared with errors.Is on both ends.
+//
+// For every service the generated file contains:
+//   - constants for the commands
+//   - a RegisterXXX function which registers an implementation on a *tcpproto.Server
+//   - a XXXClient which implements the interface by calling a *tcpproto.Client
+//
+// Usage:
+//
+//	tcpproto-gen -in users.go [-out users_tcpproto.go]
+//
+// Or with go generate:
+//
+//	//go:generate tcpproto-gen -in $GOFILE
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	in := flag.String("in", "", "the schema file")
+	out := flag.String("out", "", "the file to generate, defaults to the schema file with _tcpproto.go as suffix")
+	flag.Parse()
+
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(*in, ".go") + "_tcpproto.go"
+	}
+
+	src, err := os.ReadFile(*in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tcpproto-gen: "+err.Error())
+		os.Exit(1)
+	}
+	generated, err := Generate(*in, src)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tcpproto-gen: "+err.Error())
+		os.Exit(1)
+	}
+	err = os.WriteFile(*out, generated, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tcpproto-gen: "+err.Error())
+		os.Exit(1)
+	}
+}
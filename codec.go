@@ -0,0 +1,130 @@
+package tcpproto
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	CONTENT_TYPE_JSON = "application/json"
+	CONTENT_TYPE_GOB  = "application/x-gob"
+)
+
+// Returned when a CONTENT_TYPE has no registered codec.
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+// Codec encodes and decodes message content.
+// It is selected by the CONTENT_TYPE header.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string {
+	return CONTENT_TYPE_JSON
+}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type GobCodec struct{}
+
+func (GobCodec) ContentType() string {
+	return CONTENT_TYPE_GOB
+}
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+var (
+	codecs_mu sync.RWMutex
+	codecs    = map[string]Codec{
+		CONTENT_TYPE_JSON: JSONCodec{},
+		CONTENT_TYPE_GOB:  GobCodec{},
+	}
+)
+
+// Register a codec for its content type.
+// Registering an existing content type replaces the codec.
+func RegisterCodec(codec Codec) {
+	codecs_mu.Lock()
+	defer codecs_mu.Unlock()
+	codecs[codec.ContentType()] = codec
+}
+
+// Get the codec for a content type, parameters like "; charset=utf-8" are ignored.
+func GetCodec(content_type string) (Codec, error) {
+	content_type, _, _ = strings.Cut(content_type, ";")
+	content_type = strings.TrimSpace(content_type)
+	codecs_mu.RLock()
+	defer codecs_mu.RUnlock()
+	codec, ok := codecs[content_type]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedContentType, content_type)
+	}
+	return codec, nil
+}
+
+// The content type used by the message when no CONTENT_TYPE header is set.
+func (m *Message) defaultContentType() string {
+	if m.content_type != "" {
+		return m.content_type
+	}
+	return CONF.Content_Type
+}
+
+func (m *Message) codec() (Codec, error) {
+	content_type, ok := m.Headers["CONTENT_TYPE"]
+	if !ok || content_type == "" {
+		content_type = m.defaultContentType()
+	}
+	return GetCodec(content_type)
+}
+
+// Decode the content into v, with the codec for the CONTENT_TYPE header.
+func (m *Message) Decode(v any) error {
+	codec, err := m.codec()
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(m.Content, v)
+}
+
+// Encode v as the content, with the codec for the CONTENT_TYPE header.
+// The CONTENT_TYPE header is set to the codec used.
+func (m *Message) Encode(v any) error {
+	codec, err := m.codec()
+	if err != nil {
+		return err
+	}
+	content, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.Headers["CONTENT_TYPE"] = codec.ContentType()
+	m.Content = content
+	return nil
+}
@@ -0,0 +1,36 @@
+package tcpproto
+
+import (
+	"errors"
+	"testing"
+)
+
+type codecTest struct {
+	Name  string
+	Count int
+}
+
+func Test_Codecs(t *testing.T) {
+	for _, content_type := range []string{CONTENT_TYPE_JSON, CONTENT_TYPE_GOB} {
+		response := InitResponse("TEST")
+		response.Headers["CONTENT_TYPE"] = content_type
+		err := response.Encode(codecTest{Name: "TEST", Count: 3})
+		if err != nil {
+			t.Fatal("error encoding (" + content_type + "): " + err.Error())
+		}
+		var decoded codecTest
+		err = response.Decode(&decoded)
+		if err != nil {
+			t.Fatal("error decoding (" + content_type + "): " + err.Error())
+		}
+		if decoded.Name != "TEST" || decoded.Count != 3 {
+			t.Error("Decoded value mismatch (" + content_type + ")")
+		}
+	}
+
+	request := InitRequest("TEST")
+	request.Headers["CONTENT_TYPE"] = "application/unknown"
+	if err := request.Encode(codecTest{}); !errors.Is(err, ErrUnsupportedContentType) {
+		t.Error("Unsupported content type not rejected")
+	}
+}
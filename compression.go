@@ -0,0 +1,130 @@
+package tcpproto
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// CompressionCodec compresses and decompresses message bodies.
+// It is selected by the CONTENT_ENCODING header.
+type CompressionCodec interface {
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type deflateCodec struct{}
+
+func (deflateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (deflateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+var (
+	compression_mu     sync.RWMutex
+	compression_codecs = map[string]CompressionCodec{
+		"gzip":    gzipCodec{},
+		"deflate": deflateCodec{},
+	}
+	// Order of preference when negotiating an encoding
+	compression_order = []string{"gzip", "deflate"}
+)
+
+// Register a compression codec under the given CONTENT_ENCODING name.
+// Registering an existing name replaces the codec.
+func RegisterCompressionCodec(name string, codec CompressionCodec) {
+	compression_mu.Lock()
+	defer compression_mu.Unlock()
+	if _, ok := compression_codecs[name]; !ok {
+		compression_order = append(compression_order, name)
+	}
+	compression_codecs[name] = codec
+}
+
+func GetCompressionCodec(name string) (CompressionCodec, bool) {
+	compression_mu.RLock()
+	defer compression_mu.RUnlock()
+	codec, ok := compression_codecs[name]
+	return codec, ok
+}
+
+// The value for the ACCEPT_ENCODING header, all registered codecs in order of preference.
+func AcceptEncoding() string {
+	compression_mu.RLock()
+	defer compression_mu.RUnlock()
+	return strings.Join(compression_order, ",")
+}
+
+// Pick the first encoding from an ACCEPT_ENCODING header which has a registered codec.
+func NegotiateEncoding(accept string) (string, bool) {
+	for _, name := range strings.Split(accept, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := GetCompressionCodec(name); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func compress(encoding string, data []byte) ([]byte, error) {
+	codec, ok := GetCompressionCodec(encoding)
+	if !ok {
+		return nil, errors.New("unsupported content encoding: " + encoding)
+	}
+	buf := &bytes.Buffer{}
+	writer, err := codec.NewWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress the data, MAX_CONTENT_LENGTH applies to the decompressed size.
+func decompress(encoding string, data []byte) ([]byte, error) {
+	codec, ok := GetCompressionCodec(encoding)
+	if !ok {
+		return nil, errors.New("unsupported content encoding: " + encoding)
+	}
+	reader, err := codec.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var limited io.Reader = reader
+	if CONF.MAX_CONTENT_LENGTH > 0 {
+		limited = io.LimitReader(reader, int64(CONF.MAX_CONTENT_LENGTH)+1)
+	}
+	decompressed, err := io.ReadAll(limited)
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > CONF.MAX_CONTENT_LENGTH && CONF.MAX_CONTENT_LENGTH > 0 {
+		return nil, errors.New("content size exceeded")
+	}
+	return decompressed, nil
+}
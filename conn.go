@@ -0,0 +1,108 @@
+package tcpproto
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+)
+
+// ServerConn is a connection accepted by the server.
+// Writes are serialized, so responses and pushes can be sent from multiple goroutines.
+type ServerConn struct {
+	ID       string
+	Conn     net.Conn
+	reader   *bufio.Reader
+	ctx      context.Context
+	cancel   context.CancelFunc
+	write_mu sync.Mutex
+	// Open streams by their STREAM_ID
+	streams    map[string]*Stream
+	streams_mu sync.Mutex
+	// Encrypts the connection once the secure handshake is done
+	secure *secureConn
+}
+
+// Random hex identifier, for connections and transfers.
+func randomID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func initServerConn(conn net.Conn) *ServerConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ServerConn{
+		ID:     randomID(),
+		Conn:   conn,
+		reader: bufio.NewReaderSize(conn, CONF.BUFF_SIZE),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Write a complete frame to the connection.
+func (sc *ServerConn) Write(frame []byte) error {
+	sc.write_mu.Lock()
+	defer sc.write_mu.Unlock()
+	_, err := sc.conn().Write(frame)
+	return err
+}
+
+// The connection requests are read from and responses written to, encrypted after the secure handshake.
+func (sc *ServerConn) conn() net.Conn {
+	if sc.secure != nil {
+		return sc.secure
+	}
+	return sc.Conn
+}
+
+// Cancelled when the connection is closed.
+func (sc *ServerConn) Context() context.Context {
+	return sc.ctx
+}
+
+func (sc *ServerConn) Close() error {
+	sc.cancel()
+	return sc.Conn.Close()
+}
+
+func (s *Server) addConn(conn net.Conn) *ServerConn {
+	sc := initServerConn(conn)
+	s.conns_mu.Lock()
+	if s.conns == nil {
+		s.conns = make(map[string]*ServerConn)
+	}
+	s.conns[sc.ID] = sc
+	s.conns_mu.Unlock()
+	return sc
+}
+
+func (s *Server) removeConn(sc *ServerConn) {
+	s.conns_mu.Lock()
+	delete(s.conns, sc.ID)
+	s.conns_mu.Unlock()
+	sc.Close()
+	sc.abortStreams()
+}
+
+// Get a connected client by its connection ID.
+func (s *Server) Conn(id string) (*ServerConn, bool) {
+	s.conns_mu.RLock()
+	defer s.conns_mu.RUnlock()
+	sc, ok := s.conns[id]
+	return sc, ok
+}
+
+// IDs of all connected clients.
+func (s *Server) Conns() []string {
+	s.conns_mu.RLock()
+	defer s.conns_mu.RUnlock()
+	ids := make([]string, 0, len(s.conns))
+	for id := range s.conns {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -1,10 +1,22 @@
 package tcpproto
 
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookies holds cookies by their name, expired cookies are dropped when they are read.
+// It is safe for concurrent use.
 type Cookies struct {
+	mu sync.Mutex
 	// Cookies are stored in a map
 	// The key is the name of the cookie
 	// The value is the cookie itself
 	cookies map[string]*Cookie
+	// Copies of the cookies as they were last written to or read from the jar of the client
+	synced map[string]*Cookie
 }
 
 func InitCookies() *Cookies {
@@ -14,16 +26,72 @@ func InitCookies() *Cookies {
 }
 
 func (c *Cookies) AddCookie(cookie *Cookie) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.cookies[cookie.Name] = cookie
 }
 
+// Get the cookie, nil if it does not exist or has expired.
 func (c *Cookies) GetCookie(name string) *Cookie {
-	return c.cookies[name]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cookie, ok := c.cookies[name]
+	if !ok {
+		return nil
+	}
+	if cookie.Expired() {
+		delete(c.cookies, name)
+		return nil
+	}
+	return cookie
+}
+
+func (c *Cookies) DeleteCookie(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.cookies, name)
+}
+
+// All cookies which have not expired.
+func (c *Cookies) All() map[string]*Cookie {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cookies := make(map[string]*Cookie, len(c.cookies))
+	for name, cookie := range c.cookies {
+		if cookie.Expired() {
+			delete(c.cookies, name)
+			continue
+		}
+		cookies[name] = cookie
+	}
+	return cookies
+}
+
+// The cookies to send with the command.
+func (c *Cookies) ForCommand(command string) []*Cookie {
+	cookies := make([]*Cookie, 0)
+	for _, cookie := range c.All() {
+		if cookie.AppliesTo(command) {
+			cookies = append(cookies, cookie)
+		}
+	}
+	return cookies
+}
+
+func (c *Cookies) Len() int {
+	return len(c.All())
 }
 
 type Cookie struct {
 	Name  string
 	Value string
+	// The client drops the cookie after Expires, unless it is zero
+	Expires time.Time
+	// Seconds the cookie lives after the client received it,
+	// takes precedence over Expires. Negative values delete the cookie.
+	MaxAge int
+	// Only send the cookie with commands starting with the scope, empty sends it with every command
+	Scope string
 }
 
 func InitCookie(name string, value string) *Cookie {
@@ -32,3 +100,69 @@ func InitCookie(name string, value string) *Cookie {
 		Value: value,
 	}
 }
+
+func (c *Cookie) Expired() bool {
+	return !c.Expires.IsZero() && !time.Now().Before(c.Expires)
+}
+
+// Whether the cookie should be sent with the command.
+func (c *Cookie) AppliesTo(command string) bool {
+	return strings.HasPrefix(command, c.Scope)
+}
+
+func (c *Cookie) hasAttributes() bool {
+	return !c.Expires.IsZero() || c.MaxAge != 0 || c.Scope != ""
+}
+
+// The attributes as they are appended to the cookie name in the REMEMBER- header:
+//
+//	REMEMBER-name;Expires=1700000000;Max-Age=3600;Scope=USER.:value
+//
+// Expires is in unix seconds.
+func (c *Cookie) encodeAttributes() string {
+	attributes := ""
+	if !c.Expires.IsZero() {
+		attributes += ";Expires=" + strconv.FormatInt(c.Expires.Unix(), 10)
+	}
+	if c.MaxAge != 0 {
+		attributes += ";Max-Age=" + strconv.Itoa(c.MaxAge)
+	}
+	if c.Scope != "" {
+		attributes += ";Scope=" + c.Scope
+	}
+	return attributes
+}
+
+// Parse the cookie from a REMEMBER- header, key is the part after the prefix.
+// Unknown attributes are ignored.
+func parseCookieHeader(key string, value string) *Cookie {
+	parts := strings.Split(key, ";")
+	cookie := InitCookie(parts[0], value)
+	for _, part := range parts[1:] {
+		attribute, arg, _ := strings.Cut(part, "=")
+		switch attribute {
+		case "Expires":
+			unix, err := strconv.ParseInt(arg, 10, 64)
+			if err == nil {
+				cookie.Expires = time.Unix(unix, 0)
+			}
+		case "Max-Age":
+			max_age, err := strconv.Atoi(arg)
+			if err == nil {
+				cookie.MaxAge = max_age
+			}
+		case "Scope":
+			cookie.Scope = arg
+		}
+	}
+	return cookie
+}
+
+// Turn a Max-Age into an expiry time, when the client receives the cookie.
+func (c *Cookie) received() {
+	if c.MaxAge > 0 {
+		c.Expires = time.Now().Add(time.Duration(c.MaxAge) * time.Second)
+	} else if c.MaxAge < 0 {
+		c.Expires = time.Unix(1, 0)
+	}
+}
@@ -0,0 +1,25 @@
+package tcpproto
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Cookie_Attributes(t *testing.T) {
+	expires := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	cookie := &Cookie{Name: "TEST", Value: "VALUE", Expires: expires, MaxAge: 60, Scope: "USER."}
+	parsed := parseCookieHeader(cookie.Name+cookie.encodeAttributes(), cookie.Value)
+	if *parsed != *cookie {
+		t.Errorf("Cookie attributes were not parsed back: %+v", parsed)
+	}
+
+	if !cookie.AppliesTo("USER.Login") || cookie.AppliesTo("ADMIN.Login") {
+		t.Error("Cookie scope does not match the command prefix")
+	}
+
+	parsed.MaxAge = -1
+	parsed.received()
+	if !parsed.Expired() {
+		t.Error("Cookie with a negative Max-Age did not expire")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
 	"encoding/base64"
@@ -15,6 +16,8 @@ import (
 	"io"
 	"io/ioutil"
 	"strings"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 func BytesToBase64(b []byte) string {
@@ -44,6 +47,12 @@ func NewEncryptionKey() *[32]byte {
 // the data and provides a check that it hasn't been altered. Output takes the
 // form nonce|ciphertext|tag where '|' indicates concatenation.
 func Encrypt(plaintext []byte, key *[32]byte) (ciphertext []byte, err error) {
+	return EncryptWithAAD(plaintext, key, nil)
+}
+
+// EncryptWithAAD encrypts like Encrypt, the additional data is not encrypted
+// but must be passed to DecryptWithAAD unchanged for the data to be decrypted.
+func EncryptWithAAD(plaintext []byte, key *[32]byte, additionalData []byte) (ciphertext []byte, err error) {
 	block, err := aes.NewCipher(key[:])
 	if err != nil {
 		return nil, err
@@ -60,13 +69,18 @@ func Encrypt(plaintext []byte, key *[32]byte) (ciphertext []byte, err error) {
 		return nil, err
 	}
 
-	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
 }
 
 // Decrypt decrypts data using 256-bit AES-GCM.  This both hides the content of
 // the data and provides a check that it hasn't been altered. Expects input
 // form nonce|ciphertext|tag where '|' indicates concatenation.
 func Decrypt(ciphertext []byte, key *[32]byte) (plaintext []byte, err error) {
+	return DecryptWithAAD(ciphertext, key, nil)
+}
+
+// DecryptWithAAD decrypts data encrypted with EncryptWithAAD and the same additional data.
+func DecryptWithAAD(ciphertext []byte, key *[32]byte, additionalData []byte) (plaintext []byte, err error) {
 	if key == nil {
 		return nil, errors.New("key is nil")
 	}
@@ -90,7 +104,7 @@ func Decrypt(ciphertext []byte, key *[32]byte) (plaintext []byte, err error) {
 	return gcm.Open(nil,
 		ciphertext[:gcm.NonceSize()],
 		ciphertext[gcm.NonceSize():],
-		nil,
+		additionalData,
 	)
 }
 
@@ -111,6 +125,16 @@ func DecryptString(s string, key *[32]byte) (string, error) {
 	return string(plaintext), nil
 }
 
+// DeriveKey derives a 256-bit key from the secret with HKDF-SHA256 (RFC 5869).
+// The salt may be empty, the info label separates keys used for different purposes.
+// HKDF does not slow down guessing, so the secret should be random and not a passphrase.
+func DeriveKey(secret []byte, salt []byte, info string) *[32]byte {
+	key := [32]byte{}
+	// Reading 32 bytes from HKDF-SHA256 cannot fail
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key[:])
+	return &key
+}
+
 func KeyToBase64(key *[32]byte) string {
 	return BytesToBase64(key[:])
 }
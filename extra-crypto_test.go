@@ -0,0 +1,18 @@
+package tcpproto
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func Test_DeriveKey(t *testing.T) {
+	// RFC 5869, test case 1
+	secret, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	key := DeriveKey(secret, salt, string(info))
+	want := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf"
+	if hex.EncodeToString(key[:]) != want {
+		t.Errorf("Derived key does not match: %x", key[:])
+	}
+}
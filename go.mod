@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/Nigel2392/typeutils v1.0.0
 	github.com/shirou/gopsutil v3.21.11+incompatible
+	golang.org/x/crypto v0.1.0
 )
 
 require (
@@ -13,5 +14,5 @@ require (
 	github.com/tklauser/go-sysconf v0.3.10 // indirect
 	github.com/tklauser/numcpus v0.4.0 // indirect
 	github.com/yusufpapurcu/wmi v1.2.2 // indirect
-	golang.org/x/sys v0.0.0-20221013171732-95e765b1cc43 // indirect
+	golang.org/x/sys v0.1.0 // indirect
 )
@@ -0,0 +1,80 @@
+package tcpproto
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+)
+
+// Change CONF for a test, it is restored when the test ends.
+// Clients do not use the vault and send no system information, unless set changes it.
+func testConfig(t *testing.T, set func(conf *Config)) {
+	saved := *CONF
+	t.Cleanup(func() { *CONF = saved })
+	CONF.Use_Crypto, CONF.Include_Sysinfo = false, false
+	if set != nil {
+		set(CONF)
+	}
+}
+
+// Start the server on a free port.
+// When the test ends it stops listening, and waits for its connections to be closed.
+func startTestServer(t *testing.T, server *Server) {
+	var err error
+	if server.TLSConfig != nil {
+		server.ln, err = tls.Listen("tcp", "127.0.0.1:0", server.TLSConfig)
+	} else {
+		server.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.IP = "127.0.0.1"
+	server.Port = server.ln.Addr().(*net.TCPAddr).Port
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		server.ln.Close()
+		for _, id := range server.Conns() {
+			if sc, ok := server.Conn(id); ok {
+				sc.Close()
+			}
+		}
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := server.ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				server.handle(conn)
+			}()
+		}
+	}()
+}
+
+// Connect a client to the server, after setup has configured it.
+// The client is closed when the test ends.
+func connectTestClient(t *testing.T, server *Server, setup func(client *Client)) *Client {
+	client := InitClient(server.IP, server.Port, "")
+	if setup != nil {
+		setup(client)
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Start the server, and connect a client to it.
+func testConnect(t *testing.T, server *Server) *Client {
+	startTestServer(t, server)
+	return connectTestClient(t, server, nil)
+}
@@ -0,0 +1,301 @@
+package tcpproto
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CookieJar stores the cookies of clients per server address.
+// A jar can be shared by multiple clients, they see each other's cookies for the same server.
+// Vault values are stored as cookies as well, prefixed with VAULT-.
+type CookieJar interface {
+	// The cookies for the server which have not expired.
+	Cookies(addr string) (map[string]*Cookie, error)
+	SetCookie(addr string, cookie *Cookie) error
+	DeleteCookie(addr string, name string) error
+}
+
+// MemoryJar keeps cookies in memory, they are lost when the program exits.
+type MemoryJar struct {
+	mu      sync.Mutex
+	cookies map[string]map[string]*Cookie
+}
+
+func NewMemoryJar() *MemoryJar {
+	return &MemoryJar{
+		cookies: make(map[string]map[string]*Cookie),
+	}
+}
+
+func (j *MemoryJar) Cookies(addr string) (map[string]*Cookie, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return copyCookies(j.cookies[addr]), nil
+}
+
+func (j *MemoryJar) SetCookie(addr string, cookie *Cookie) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	setCookie(j.cookies, addr, cookie)
+	return nil
+}
+
+func (j *MemoryJar) DeleteCookie(addr string, name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.cookies[addr], name)
+	return nil
+}
+
+// Copy the cookies which have not expired.
+func copyCookies(cookies map[string]*Cookie) map[string]*Cookie {
+	copied := make(map[string]*Cookie, len(cookies))
+	for name, cookie := range cookies {
+		if cookie.Expired() {
+			continue
+		}
+		c := *cookie
+		copied[name] = &c
+	}
+	return copied
+}
+
+func setCookie(cookies map[string]map[string]*Cookie, addr string, cookie *Cookie) {
+	if cookies[addr] == nil {
+		cookies[addr] = make(map[string]*Cookie)
+	}
+	c := *cookie
+	cookies[addr][cookie.Name] = &c
+}
+
+// FileJar keeps cookies in a JSON file, readable only by the current user.
+// Changes made by other processes using the same file are picked up.
+type FileJar struct {
+	Path     string
+	mu       sync.Mutex
+	cookies  map[string]map[string]*Cookie
+	mod_time time.Time
+}
+
+// Open the jar, the file is created when the first cookie is stored.
+func NewFileJar(path string) (*FileJar, error) {
+	jar := &FileJar{
+		Path:    path,
+		cookies: make(map[string]map[string]*Cookie),
+	}
+	err := jar.load()
+	if err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
+
+// Read the file again if it has been changed since it was last read.
+func (j *FileJar) load() error {
+	info, err := os.Stat(j.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(j.mod_time) {
+		return nil
+	}
+	data, err := os.ReadFile(j.Path)
+	if err != nil {
+		return err
+	}
+	cookies := make(map[string]map[string]*Cookie)
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &cookies)
+		if err != nil {
+			return errors.New("error reading cookie jar: " + err.Error())
+		}
+	}
+	j.cookies = cookies
+	j.mod_time = info.ModTime()
+	return nil
+}
+
+func (j *FileJar) save() error {
+	// Expired cookies are not worth keeping
+	for addr, cookies := range j.cookies {
+		j.cookies[addr] = copyCookies(cookies)
+		if len(j.cookies[addr]) == 0 {
+			delete(j.cookies, addr)
+		}
+	}
+	data, err := json.Marshal(j.cookies)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(j.Path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so the jar is never read half written
+	tmp, err := os.CreateTemp(dir, ".cookies-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), j.Path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	info, err := os.Stat(j.Path)
+	if err == nil {
+		j.mod_time = info.ModTime()
+	}
+	return nil
+}
+
+func (j *FileJar) Cookies(addr string) (map[string]*Cookie, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.load()
+	if err != nil {
+		return nil, err
+	}
+	return copyCookies(j.cookies[addr]), nil
+}
+
+func (j *FileJar) SetCookie(addr string, cookie *Cookie) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.load()
+	if err != nil {
+		return err
+	}
+	setCookie(j.cookies, addr, cookie)
+	return j.save()
+}
+
+func (j *FileJar) DeleteCookie(addr string, name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := j.cookies[addr][name]; !ok {
+		return nil
+	}
+	delete(j.cookies[addr], name)
+	return j.save()
+}
+
+// Bring the cookies of the client in line with its jar.
+// Cookies changed on the client directly since the last sync are written to the jar,
+// other cookies are taken from the jar, which may have been changed by another client.
+func (c *Client) syncJar() error {
+	if c.Jar == nil {
+		return nil
+	}
+	addr := c.Addr()
+	base, changed, deleted := c.Cookies.jarChanges()
+	for _, name := range deleted {
+		err := c.Jar.DeleteCookie(addr, name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, cookie := range changed {
+		err := c.Jar.SetCookie(addr, cookie)
+		if err != nil {
+			return err
+		}
+	}
+	cookies, err := c.Jar.Cookies(addr)
+	if err != nil {
+		return err
+	}
+	c.Cookies.mergeJar(base, cookies)
+	return nil
+}
+
+func sameCookie(a *Cookie, b *Cookie) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Record the cookie as written to the jar.
+func (c *Cookies) setSynced(cookie *Cookie) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.synced == nil {
+		c.synced = make(map[string]*Cookie)
+	}
+	synced := *cookie
+	c.synced[cookie.Name] = &synced
+}
+
+// Record the cookie as deleted from the jar.
+func (c *Cookies) deleteSynced(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.synced, name)
+}
+
+// The cookies changed and the names of the cookies deleted since the last sync.
+// Base is a copy of the cookies, which the jar holds once the changes are written.
+func (c *Cookies) jarChanges() (map[string]*Cookie, []*Cookie, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	base := copyCookies(c.cookies)
+	changed := make([]*Cookie, 0)
+	deleted := make([]string, 0)
+	for name := range c.synced {
+		if _, ok := base[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+	for name, cookie := range base {
+		if !sameCookie(cookie, c.synced[name]) {
+			changed = append(changed, cookie)
+		}
+	}
+	return base, changed, deleted
+}
+
+// Take the cookies of the jar, except those changed on the client since base was taken,
+// like cookies a response stored while the jar was read.
+func (c *Cookies) mergeJar(base map[string]*Cookie, jar map[string]*Cookie) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.synced == nil {
+		c.synced = make(map[string]*Cookie)
+	}
+	for name, cookie := range jar {
+		if !sameCookie(c.cookies[name], base[name]) {
+			continue
+		}
+		c.cookies[name] = cookie
+		synced := *cookie
+		c.synced[name] = &synced
+	}
+	// Cookies another client removed from the jar
+	for name, cookie := range c.cookies {
+		if _, ok := jar[name]; ok || !sameCookie(cookie, base[name]) {
+			continue
+		}
+		delete(c.cookies, name)
+		delete(c.synced, name)
+	}
+}
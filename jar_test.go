@@ -0,0 +1,81 @@
+package tcpproto
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_FileJar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.json")
+	jar, err := NewFileJar(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar.SetCookie("127.0.0.1:12239", InitCookie("TEST", "VALUE"))
+	jar.SetCookie("127.0.0.1:12239", &Cookie{Name: "EXPIRED", Value: "VALUE", Expires: time.Now().Add(-time.Second)})
+	jar.SetCookie("127.0.0.1:22239", InitCookie("OTHER", "VALUE"))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Cookie jar is readable by others: %v", info.Mode().Perm())
+	}
+
+	// Another process opening the same file
+	reopened, err := NewFileJar(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies, _ := reopened.Cookies("127.0.0.1:12239")
+	if len(cookies) != 1 || cookies["TEST"] == nil || cookies["TEST"].Value != "VALUE" {
+		t.Errorf("Cookies were not persisted per server: %v", cookies)
+	}
+
+	reopened.DeleteCookie("127.0.0.1:12239", "TEST")
+	cookies, _ = jar.Cookies("127.0.0.1:12239")
+	if _, ok := cookies["TEST"]; ok {
+		t.Error("Cookie deleted by another jar was still returned")
+	}
+}
+
+func Test_Jar_ConcurrentSend(t *testing.T) {
+	testConfig(t, nil)
+	server := InitServer("127.0.0.1", 0, "")
+	server.AddCallback("COUNT", func(rq *Request, resp *Response) {
+		resp.Remember("C"+rq.Headers["N"], "1")
+	})
+	client := testConnect(t, server)
+
+	// Cookies stored by one response must not be dropped by another request syncing the jar
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				rq := InitRequest("COUNT")
+				rq.Headers["N"] = strconv.Itoa(i*5 + j)
+				if _, err := client.Send(rq); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	jar_cookies, _ := client.Jar.Cookies(client.Addr())
+	for n := 0; n < 100; n++ {
+		name := "C" + strconv.Itoa(n)
+		if client.Cookies.GetCookie(name) == nil {
+			t.Error("Cookie dropped from the client: " + name)
+		}
+		if jar_cookies[name] == nil {
+			t.Error("Cookie dropped from the jar: " + name)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package tcpproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Message holds everything requests and responses have in common:
+// the headers, the content and an optional file.
+// Encoding and decoding of the frame is done here, so both directions behave the same.
+type Message struct {
+	Headers map[string]string
+	Content []byte
+	File    *FileData
+	// Content type used to Encode and Decode when no CONTENT_TYPE header is set
+	content_type string
+}
+
+func initMessage() Message {
+	return Message{
+		Headers: make(map[string]string),
+		Content: []byte{},
+		File: &FileData{
+			Name:     "",
+			Size:     0,
+			Boundary: "",
+			Present:  false,
+			Content:  []byte{},
+		},
+	}
+}
+
+func (m *Message) AddHeader(key string, value string) {
+	m.Headers[key] = value
+}
+
+func (m *Message) AddFile(filename string, file []byte, boundary string) {
+	m.File.Name = filename
+	m.File.Size = len(file)
+	m.File.Content = file
+	m.File.Present = true
+	m.File.Boundary = boundary
+}
+
+// Length of the content, including the file and its boundaries.
+func (m *Message) ContentLength() int {
+	if m.File.Present {
+		return len(m.File.StartBoundary()) + len(m.File.Content) + len(m.File.EndBoundary()) + len(m.Content)
+	}
+	return len(m.Content)
+}
+
+// The content as it is sent over the wire, with the file prepended if present.
+func (m *Message) body() []byte {
+	if !m.File.Present {
+		return m.Content
+	}
+	content := make([]byte, 0, m.ContentLength())
+	content = append(content, m.File.StartBoundary()...)
+	content = append(content, m.File.Content...)
+	content = append(content, m.File.EndBoundary()...)
+	content = append(content, m.Content...)
+	return content
+}
+
+// Generate the header lines, extra is appended after the message's own headers.
+func (m *Message) genHeader(extra string) string {
+	header := ""
+	for key, value := range m.Headers {
+		header += key + ":" + value + "\r\n"
+	}
+	return header + extra + "\r\n"
+}
+
+// Encode the message into a frame.
+func (m *Message) encode(extra string) ([]byte, error) {
+	// Set up file if present
+	if m.File.Present {
+		m.Headers["FILE_NAME"] = m.File.Name
+		m.Headers["FILE_SIZE"] = strconv.Itoa(m.File.Size)
+		m.Headers["FILE_BOUNDARY"] = m.File.Boundary
+		m.Headers["HAS_FILE"] = "true"
+		// Checksum the file with the same algorithm as the content
+		if algorithm, ok := m.Headers["CONTENT_CHECKSUM"]; ok {
+			if _, ok := m.Headers["FILE_CHECKSUM"]; !ok {
+				m.Headers["FILE_CHECKSUM"] = algorithm
+			}
+		}
+		if _, ok := m.Headers["FILE_CHECKSUM"]; ok {
+			err := setChecksum(m.Headers, "FILE_CHECKSUM", m.File.Content)
+			if err != nil {
+				CONF.LOGGER.Error(err.Error())
+				return nil, err
+			}
+		}
+	} else {
+		delete(m.Headers, "FILE_CHECKSUM")
+	}
+	if _, ok := m.Headers["PROTO_VERSION"]; !ok {
+		m.Headers["PROTO_VERSION"] = strconv.Itoa(PROTO_VERSION)
+	}
+	content := m.body()
+	// Compress the content if an encoding was set
+	if encoding, ok := m.Headers["CONTENT_ENCODING"]; ok {
+		if len(content) >= CONF.COMPRESSION_MIN_SIZE {
+			compressed, err := compress(encoding, content)
+			if err != nil {
+				CONF.LOGGER.Error(err.Error())
+				return nil, err
+			}
+			content = compressed
+		} else {
+			delete(m.Headers, "CONTENT_ENCODING")
+		}
+	}
+	m.Headers["CONTENT_LENGTH"] = strconv.Itoa(len(content))
+	// Checksum the content as it is sent over the wire
+	if _, ok := m.Headers["CONTENT_CHECKSUM"]; ok {
+		err := setChecksum(m.Headers, "CONTENT_CHECKSUM", content)
+		if err != nil {
+			CONF.LOGGER.Error(err.Error())
+			return nil, err
+		}
+	}
+	// Generate the header, announced checksums are sent after the content.
+	// The content is still fully buffered, the trailer only moves the checksum on the wire.
+	var header, trailer string
+	if announced, ok := m.Headers["TRAILER"]; ok {
+		names, err := trailerNames(announced)
+		if err != nil {
+			CONF.LOGGER.Error(err.Error())
+			return nil, err
+		}
+		trailers := make(map[string]string)
+		for _, name := range names {
+			if value, ok := m.Headers[name]; ok {
+				trailers[name] = value
+				delete(m.Headers, name)
+				trailer += name + ":" + value + "\r\n"
+			}
+		}
+		if trailer != "" {
+			trailer += "\r\n"
+		} else {
+			// Nothing to send after the content, the receiver must not wait for a trailer
+			delete(m.Headers, "TRAILER")
+		}
+		header = m.genHeader(extra)
+		for name, value := range trailers {
+			m.Headers[name] = value
+		}
+	} else {
+		header = m.genHeader(extra)
+	}
+	frame := make([]byte, 0, len(header)+len(content)+len(trailer))
+	frame = append(frame, header...)
+	frame = append(frame, content...)
+	frame = append(frame, trailer...)
+	return frame, nil
+}
+
+// Decode the message after the headers and raw content have been read.
+func (m *Message) decode() error {
+	// Verify the content as it was received
+	err := verifyChecksumHeader(m.Headers, "CONTENT_CHECKSUM", m.Content)
+	if err != nil {
+		CONF.LOGGER.Error(err.Error())
+		return err
+	}
+	// Decompress the content
+	if encoding, ok := m.Headers["CONTENT_ENCODING"]; ok {
+		content, err := decompress(encoding, m.Content)
+		if err != nil {
+			CONF.LOGGER.Error(err.Error())
+			return err
+		}
+		m.Content = content
+		delete(m.Headers, "CONTENT_ENCODING")
+	}
+	// Parse the file if one exists
+	err = m.ParseFile()
+	if err != nil {
+		return err
+	}
+	if m.File.Present {
+		err = verifyChecksumHeader(m.Headers, "FILE_CHECKSUM", m.File.Content)
+		if err != nil {
+			CONF.LOGGER.Error(err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Message) ParseFile() error {
+	// Check if data includes a file
+	has_file, ok := m.Headers["HAS_FILE"]
+	if !ok {
+		return nil
+	}
+	has, err := strconv.ParseBool(has_file)
+	if err != nil || !has {
+		return nil
+	}
+	// Read the file
+	file_name, ok := m.Headers["FILE_NAME"]
+	if !ok {
+		err := errors.New("file name not found")
+		CONF.LOGGER.Error(err.Error())
+		return err
+	}
+	file_size, ok := m.Headers["FILE_SIZE"]
+	if !ok {
+		err := errors.New("file size not found")
+		CONF.LOGGER.Error(err.Error())
+		return err
+	}
+	file_boundary, ok := m.Headers["FILE_BOUNDARY"]
+	if !ok {
+		err := errors.New("file boundary not found")
+		CONF.LOGGER.Error(err.Error())
+		return err
+	}
+	file_size_int, err := strconv.Atoi(file_size)
+	if err != nil {
+		err := errors.New("invalid file size")
+		CONF.LOGGER.Error(err.Error())
+		return err
+	}
+	// Set up file
+	m.File.Name = file_name
+	m.File.Size = file_size_int
+	m.File.Boundary = file_boundary
+	// Parse and remove file from the content
+	_, err = m.ParseFileData()
+	if err != nil {
+		CONF.LOGGER.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (m *Message) ParseFileData() ([]byte, error) {
+	// Set up the file boundary for parsing
+	start_boundary := m.File.StartBoundary()
+	end_boundary := m.File.EndBoundary()
+	// Verify that the starting boundary is in the message
+	start_index := bytes.Index(m.Content, start_boundary)
+	if start_index == -1 {
+		return nil, nil
+	}
+	// The file size is known, so the ending boundary must directly follow the file
+	file_start := start_index + len(start_boundary)
+	file_end := file_start + m.File.Size
+	if m.File.Size < 0 || file_end > len(m.Content) {
+		return nil, errors.New("file size does not match")
+	}
+	if !bytes.HasPrefix(m.Content[file_end:], end_boundary) {
+		return nil, errors.New("file size does not match")
+	}
+	// Extract the file data from the content
+	file := m.Content[file_start:file_end]
+	// Remove the file and boundaries from the content
+	content := make([]byte, 0, len(m.Content)-(file_end+len(end_boundary)-start_index))
+	content = append(content, m.Content[:start_index]...)
+	content = append(content, m.Content[file_end+len(end_boundary):]...)
+	m.Content = content
+	// Set the file data
+	m.File.Present = true
+	m.File.Content = file
+	return file, nil
+}
+
+// Split a single header line into its key and value.
+func parseHeaderLine(line []byte) (string, string, error) {
+	line_data := bytes.SplitN(bytes.TrimSpace(line), []byte(":"), 2)
+	if len(line_data) != 2 {
+		err := errors.New("invalid key:value split: " + fmt.Sprintf("%v", line_data))
+		CONF.LOGGER.Error(err.Error())
+		return "", "", err
+	}
+	key := bytes.Replace(line_data[0], []byte(" "), []byte(""), -1)
+	return string(key), string(bytes.TrimSpace(line_data[1])), nil
+}
+
+// Read header lines up until the first empty line into header.
+// The returned size is the amount of bytes read.
+func readHeaderBlock(reader *bufio.Reader, header map[string]string, size int) (int, error) {
+	start := len(header)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF && len(header) == start && len(line) == 0 {
+				return size, io.EOF
+			}
+			return size, errors.New("error reading header")
+		}
+		size += len(line)
+		if size > CONF.MAX_HEADER_SIZE && CONF.MAX_HEADER_SIZE > 0 {
+			return size, errors.New("header size exceeded")
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			if len(header) == start {
+				// Skip empty lines in between frames
+				continue
+			}
+			return size, nil
+		}
+		key, value, err := parseHeaderLine(line)
+		if err != nil {
+			return size, err
+		}
+		header[key] = value
+	}
+}
+
+// Headers which may be sent after the content.
+var trailerKeys = map[string]bool{
+	"CONTENT_CHECKSUM": true,
+	"FILE_CHECKSUM":    true,
+}
+
+// Parse the comma separated names of a TRAILER header.
+// Only the checksums may be sent as trailers.
+func trailerNames(announced string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(announced, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !trailerKeys[name] {
+			return nil, errors.New("header not allowed as trailer: " + name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Read a single frame off the reader.
+// Returns the headers, including any trailers, and the raw content.
+// The content is read into memory completely before the trailers are read.
+func readFrame(reader *bufio.Reader) (map[string]string, []byte, error) {
+	header := make(map[string]string)
+	header_size, err := readHeaderBlock(reader, header, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Get the content length
+	content_length, err := strconv.Atoi(header["CONTENT_LENGTH"])
+	if err != nil || content_length < 0 {
+		err = errors.New("content length not an integer: " + header["CONTENT_LENGTH"])
+		CONF.LOGGER.Error(err.Error())
+		return nil, nil, err
+	}
+	if content_length > CONF.MAX_CONTENT_LENGTH && CONF.MAX_CONTENT_LENGTH > 0 {
+		return nil, nil, errors.New("content size exceeded")
+	}
+
+	// Read the rest of the content
+	content := make([]byte, content_length)
+	_, err = io.ReadFull(reader, content)
+	if err != nil {
+		err = errors.New("content length mismatch: " + err.Error())
+		CONF.LOGGER.Error(err.Error())
+		return nil, nil, err
+	}
+
+	// Read the trailers announced in the header, nothing else is accepted
+	if announced, ok := header["TRAILER"]; ok {
+		names, err := trailerNames(announced)
+		if err != nil {
+			CONF.LOGGER.Error(err.Error())
+			return nil, nil, err
+		}
+		allowed := make(map[string]bool, len(names))
+		for _, name := range names {
+			allowed[name] = true
+		}
+		trailers := make(map[string]string)
+		_, err = readHeaderBlock(reader, trailers, header_size)
+		if err != nil {
+			return nil, nil, err
+		}
+		for key, value := range trailers {
+			if !allowed[key] {
+				err = errors.New("trailer was not announced: " + key)
+				CONF.LOGGER.Error(err.Error())
+				return nil, nil, err
+			}
+			header[key] = value
+		}
+	}
+	return header, content, nil
+}
@@ -0,0 +1,260 @@
+package tcpproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeFrame(t *testing.T, frame []byte) Message {
+	header, content, err := readFrame(bufio.NewReader(bytes.NewReader(frame)))
+	if err != nil {
+		t.Fatal("error reading frame: " + err.Error())
+	}
+	msg := initMessage()
+	msg.Headers = header
+	msg.Content = content
+	if err := msg.decode(); err != nil {
+		t.Fatal("error decoding message: " + err.Error())
+	}
+	return msg
+}
+
+func Test_Message_Roundtrip(t *testing.T) {
+	content := []byte(strings.Repeat("TEST_CONTENT\n", 100))
+	file := []byte(strings.Repeat("TEST_FILE_CONTENT\n", 100))
+
+	request := InitRequest("TEST")
+	request.Content = content
+	request.AddFile("test.txt", file, "BOUNDARY")
+	rqt, err := request.Generate()
+	if err != nil {
+		t.Fatal("error generating request: " + err.Error())
+	}
+
+	response := InitResponse("TEST")
+	response.Content = content
+	response.AddFile("test.txt", file, "BOUNDARY")
+	resp := response.Generate()
+
+	for name, frame := range map[string][]byte{"request": rqt, "response": resp} {
+		msg := decodeFrame(t, frame)
+		if !bytes.Equal(msg.Content, content) {
+			t.Error("Content mismatch (" + name + ")")
+		}
+		if !msg.File.Present || msg.File.Name != "test.txt" {
+			t.Error("File not parsed (" + name + ")")
+		}
+		if !bytes.Equal(msg.File.Content, file) {
+			t.Error("File content mismatch (" + name + ")")
+		}
+	}
+}
+
+func Test_Message_Pipelined(t *testing.T) {
+	var frames []byte
+	for _, content := range []string{"FIRST", "SECOND"} {
+		request := InitRequest("TEST")
+		request.Content = []byte(content)
+		rqt, _ := request.Generate()
+		frames = append(frames, rqt...)
+	}
+	reader := bufio.NewReader(bytes.NewReader(frames))
+	for _, content := range []string{"FIRST", "SECOND"} {
+		_, recv, err := readFrame(reader)
+		if err != nil {
+			t.Fatal("error reading frame: " + err.Error())
+		}
+		if string(recv) != content {
+			t.Error("Content mismatch: " + string(recv) + " != " + content)
+		}
+	}
+}
+
+func Test_Message_Compression(t *testing.T) {
+	content := []byte(strings.Repeat("TEST_CONTENT\n", 1000))
+	for _, encoding := range []string{"gzip", "deflate"} {
+		response := InitResponse("TEST")
+		response.Content = content
+		response.Headers["CONTENT_ENCODING"] = encoding
+		resp := response.Generate()
+		if len(resp) >= len(content) {
+			t.Error("Content not compressed (" + encoding + ")")
+		}
+		msg := decodeFrame(t, resp)
+		if !bytes.Equal(msg.Content, content) {
+			t.Error("Content mismatch (" + encoding + ")")
+		}
+	}
+
+	max_length := CONF.MAX_CONTENT_LENGTH
+	CONF.MAX_CONTENT_LENGTH = KILOBYTE
+	defer func() { CONF.MAX_CONTENT_LENGTH = max_length }()
+	compressed, err := compress("gzip", content)
+	if err != nil {
+		t.Fatal("error compressing content: " + err.Error())
+	}
+	if len(compressed) > KILOBYTE {
+		t.Fatal("compressed content too large for test")
+	}
+	_, err = decompress("gzip", compressed)
+	if err == nil {
+		t.Error("MAX_CONTENT_LENGTH not applied to decompressed content")
+	}
+}
+
+func Test_Message_Checksum(t *testing.T) {
+	for _, algorithm := range []string{"crc32c", "sha256"} {
+		for _, trailer := range []bool{false, true} {
+			request := InitRequest("TEST")
+			request.Content = []byte(strings.Repeat("TEST_CONTENT\n", 100))
+			request.AddFile("test.txt", []byte("TEST_FILE_CONTENT"), "BOUNDARY")
+			request.Headers["CONTENT_CHECKSUM"] = algorithm
+			if trailer {
+				request.Headers["TRAILER"] = "CONTENT_CHECKSUM"
+			}
+			rqt, err := request.Generate()
+			if err != nil {
+				t.Fatal("error generating request: " + err.Error())
+			}
+			msg := decodeFrame(t, rqt)
+			if !strings.HasPrefix(msg.Headers["CONTENT_CHECKSUM"], algorithm+"=") {
+				t.Error("CONTENT_CHECKSUM not received: " + msg.Headers["CONTENT_CHECKSUM"])
+			}
+			if !strings.HasPrefix(msg.Headers["FILE_CHECKSUM"], algorithm+"=") {
+				t.Error("FILE_CHECKSUM not received: " + msg.Headers["FILE_CHECKSUM"])
+			}
+
+			// Corrupt the last byte of the content
+			index := bytes.LastIndex(rqt, []byte("TEST_CONTENT\n")) + 1
+			rqt[index] = 'X'
+			header, content, err := readFrame(bufio.NewReader(bytes.NewReader(rqt)))
+			if err != nil {
+				t.Fatal("error reading frame: " + err.Error())
+			}
+			corrupted := initMessage()
+			corrupted.Headers = header
+			corrupted.Content = content
+			if err := corrupted.decode(); !errors.Is(err, ErrChecksumMismatch) {
+				t.Error("Corrupted content not rejected (" + algorithm + ")")
+			}
+		}
+	}
+}
+
+func Test_Message_Trailer(t *testing.T) {
+	request := InitRequest("TEST")
+	request.Content = []byte("TEST_CONTENT")
+	request.AddFile("test.txt", []byte("TEST_FILE_CONTENT"), "BOUNDARY")
+	request.Headers["CONTENT_CHECKSUM"] = "sha256"
+	request.Headers["TRAILER"] = "CONTENT_CHECKSUM, FILE_CHECKSUM"
+	rqt, err := request.Generate()
+	if err != nil {
+		t.Fatal("error generating request: " + err.Error())
+	}
+	index := bytes.Index(rqt, []byte("TEST_CONTENT"))
+	if bytes.Contains(rqt[:index], []byte("CHECKSUM:sha256=")) {
+		t.Error("Checksums were sent before the content")
+	}
+	msg := decodeFrame(t, rqt)
+	if !strings.HasPrefix(msg.Headers["FILE_CHECKSUM"], "sha256=") {
+		t.Error("FILE_CHECKSUM trailer not received: " + msg.Headers["FILE_CHECKSUM"])
+	}
+
+	// Without a file there is nothing to send after the content
+	request = InitRequest("TEST")
+	request.Content = []byte("TEST_CONTENT")
+	request.Headers["TRAILER"] = "FILE_CHECKSUM"
+	rqt, err = request.Generate()
+	if err != nil {
+		t.Fatal("error generating request: " + err.Error())
+	}
+	if bytes.Contains(rqt, []byte("TRAILER:")) {
+		t.Error("Trailer announced without trailer values")
+	}
+	reader := bufio.NewReader(bytes.NewReader(append(rqt, rqt...)))
+	for i := 0; i < 2; i++ {
+		if _, content, err := readFrame(reader); err != nil || string(content) != "TEST_CONTENT" {
+			t.Errorf("Frame %d without trailer values was not read: %v %q", i, err, content)
+		}
+	}
+
+	// Only the announced checksums are accepted after the content
+	frames := map[string]string{
+		"unannounced": "TRAILER:CONTENT_CHECKSUM\r\nCONTENT_LENGTH:4\r\n\r\nTESTUSER_ID:1\r\n\r\n",
+		"not allowed": "TRAILER:USER_ID\r\nCONTENT_LENGTH:4\r\n\r\nTESTUSER_ID:1\r\n\r\n",
+	}
+	for name, frame := range frames {
+		_, _, err := readFrame(bufio.NewReader(strings.NewReader(frame)))
+		if err == nil {
+			t.Error("Trailer accepted: " + name)
+		}
+	}
+}
+
+func Test_Message_EncodeError(t *testing.T) {
+	testConfig(t, nil)
+	server := InitServer("127.0.0.1", 0, "")
+	server.AddCallback("MD5", func(rq *Request, resp *Response) {
+		resp.Headers["CONTENT_CHECKSUM"] = "md5"
+		resp.Content = []byte("content")
+	})
+	client := testConnect(t, server)
+
+	// The client gets an error instead of waiting for a response which is never sent
+	done := make(chan error, 1)
+	go func() {
+		resp, err := client.Send(InitRequest("MD5"))
+		if err == nil && resp.Status() != STATUS_INTERNAL_ERROR {
+			err = errors.New("wrong status: " + resp.Headers["STATUS"])
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Response which could not be encoded was never answered")
+	}
+
+	msg := InitResponse("NEWS")
+	msg.Headers["CONTENT_CHECKSUM"] = "md5"
+	for _, id := range server.Conns() {
+		if err := server.Push(id, msg); err == nil {
+			t.Error("Push which could not be encoded was sent")
+		}
+	}
+	if err := server.Broadcast(msg); err == nil {
+		t.Error("Broadcast which could not be encoded was sent")
+	}
+}
+
+func Test_Message_DecodeError(t *testing.T) {
+	testConfig(t, nil)
+	server := InitServer("127.0.0.1", 0, "")
+	startTestServer(t, server)
+	conn, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("COMMAND:TEST\r\nREQUEST_ID:7\r\nCONTENT_CHECKSUM:sha256=00\r\nCONTENT_LENGTH:4\r\n\r\nTEST"))
+	header, content, err := readFrame(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header["STATUS"] != strconv.Itoa(STATUS_BAD_REQUEST) || header["ERROR_TYPE"] != ERROR_TYPE_DECODE {
+		t.Errorf("Wrong error for a checksum mismatch: %s %s %q", header["STATUS"], header["ERROR_TYPE"], content)
+	}
+	if header["REQUEST_ID"] != "7" {
+		t.Error("Request ID was not kept: " + header["REQUEST_ID"])
+	}
+}
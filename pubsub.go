@@ -0,0 +1,347 @@
+package tcpproto
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Commands of the publish/subscribe subsystem.
+// The topic, or topic pattern, is sent in the TOPIC header.
+const (
+	COMMAND_SUBSCRIBE   = "SUBSCRIBE"
+	COMMAND_UNSUBSCRIBE = "UNSUBSCRIBE"
+	COMMAND_PUBLISH     = "PUBLISH"
+)
+
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// PubSub fans published messages out to the connections subscribed to their topic.
+//
+// Topics are separated by dots, like "news.sports".
+// Patterns can use * to match a single part, and # as the last part to match any remaining parts.
+type PubSub struct {
+	// Messages queued per subscriber before it is disconnected for falling behind
+	BufferSize int
+	// Decide whether the client may subscribe to the pattern, or publish to the topic.
+	// The command is COMMAND_SUBSCRIBE or COMMAND_PUBLISH, and every topic is allowed when nil.
+	// Return a *StatusError to choose the status of the refusal, other errors are sent as STATUS_FORBIDDEN.
+	// Patterns with wildcards can match more topics than the pattern names.
+	Authorize   func(rq *Request, command string, topic string) error
+	mu          sync.RWMutex
+	subscribers map[string]*subscriber
+}
+
+type subscriber struct {
+	conn     *ServerConn
+	patterns map[string]bool
+	queue    chan []byte
+	done     chan struct{}
+}
+
+// Enable the SUBSCRIBE, UNSUBSCRIBE and PUBLISH commands on the server.
+func (s *Server) EnablePubSub() *PubSub {
+	if s.PubSub != nil {
+		return s.PubSub
+	}
+	s.PubSub = &PubSub{
+		BufferSize:  CONF.PUBSUB_BUFFER_SIZE,
+		subscribers: make(map[string]*subscriber),
+	}
+	s.AddCallback(COMMAND_SUBSCRIBE, s.handleSubscribe)
+	s.AddCallback(COMMAND_UNSUBSCRIBE, s.handleUnsubscribe)
+	s.AddCallback(COMMAND_PUBLISH, s.handlePublish)
+	return s.PubSub
+}
+
+func (s *Server) handleSubscribe(rq *Request, resp *Response) {
+	pattern := rq.Headers["TOPIC"]
+	if !s.PubSub.authorize(rq, resp, COMMAND_SUBSCRIBE, pattern) {
+		return
+	}
+	sc, ok := s.Conn(rq.ConnID)
+	if !ok {
+		resp.SetError(STATUS_INTERNAL_ERROR, "connection not found")
+		return
+	}
+	err := s.PubSub.Subscribe(sc, pattern)
+	if err != nil {
+		resp.SetError(STATUS_BAD_REQUEST, err.Error())
+	}
+}
+
+func (s *Server) handleUnsubscribe(rq *Request, resp *Response) {
+	s.PubSub.Unsubscribe(rq.ConnID, rq.Headers["TOPIC"])
+}
+
+func (s *Server) handlePublish(rq *Request, resp *Response) {
+	if !s.PubSub.authorize(rq, resp, COMMAND_PUBLISH, rq.Headers["TOPIC"]) {
+		return
+	}
+	msg := InitResponse()
+	msg.Content = rq.Content
+	if content_type, ok := rq.Headers["CONTENT_TYPE"]; ok {
+		msg.Headers["CONTENT_TYPE"] = content_type
+	}
+	n, err := s.PubSub.Publish(rq.Headers["TOPIC"], msg)
+	if err != nil {
+		resp.SetError(STATUS_BAD_REQUEST, err.Error())
+		return
+	}
+	resp.Headers["SUBSCRIBERS"] = strconv.Itoa(n)
+}
+
+// Ask the Authorize hook, the refusal is written to the response.
+func (ps *PubSub) authorize(rq *Request, resp *Response, command string, topic string) bool {
+	if ps.Authorize == nil {
+		return true
+	}
+	err := ps.Authorize(rq, command, topic)
+	if err == nil {
+		return true
+	}
+	var status_err *StatusError
+	if errors.As(err, &status_err) {
+		resp.SetError(status_err.Status, status_err.Message)
+	} else {
+		resp.SetError(STATUS_FORBIDDEN, err.Error())
+	}
+	return false
+}
+
+// Subscribe a connection to the topics matching the pattern.
+func (ps *PubSub) Subscribe(sc *ServerConn, pattern string) error {
+	err := validateTopic(pattern, true)
+	if err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sub, ok := ps.subscribers[sc.ID]
+	if !ok {
+		buffer_size := ps.BufferSize
+		if buffer_size <= 0 {
+			buffer_size = 1
+		}
+		sub = &subscriber{
+			conn:     sc,
+			patterns: make(map[string]bool),
+			queue:    make(chan []byte, buffer_size),
+			done:     make(chan struct{}),
+		}
+		ps.subscribers[sc.ID] = sub
+		go ps.write(sub)
+	}
+	sub.patterns[pattern] = true
+	return nil
+}
+
+// Remove a subscription of a connection.
+func (ps *PubSub) Unsubscribe(connID string, pattern string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sub, ok := ps.subscribers[connID]
+	if !ok {
+		return
+	}
+	delete(sub.patterns, pattern)
+	if len(sub.patterns) == 0 {
+		ps.remove(sub)
+	}
+}
+
+// Publish a message to every connection subscribed to the topic.
+// Returns the number of subscribers the message was queued for.
+// Subscribers whose buffer is full are disconnected.
+func (ps *PubSub) Publish(topic string, msg *Response) (int, error) {
+	err := validateTopic(topic, false)
+	if err != nil {
+		return 0, err
+	}
+	msg.Headers["MESSAGE_TYPE"] = MESSAGE_TYPE_PUSH
+	msg.Headers["COMMAND"] = COMMAND_PUBLISH
+	msg.Headers["TOPIC"] = topic
+	frame, err := msg.generate()
+	if err != nil {
+		return 0, err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	n := 0
+	for _, sub := range ps.subscribers {
+		if !sub.matches(topic) {
+			continue
+		}
+		select {
+		case sub.queue <- frame:
+			n++
+		default:
+			CONF.LOGGER.Warning("Disconnecting slow subscriber: " + sub.conn.ID)
+			ps.remove(sub)
+			sub.conn.Close()
+		}
+	}
+	return n, nil
+}
+
+// Number of connections with a subscription.
+func (ps *PubSub) Subscribers() int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.subscribers)
+}
+
+// Write queued messages to the subscriber until it unsubscribes or disconnects.
+func (ps *PubSub) write(sub *subscriber) {
+	for {
+		select {
+		case frame := <-sub.queue:
+			err := sub.conn.Write(frame)
+			if err != nil {
+				ps.mu.Lock()
+				ps.remove(sub)
+				ps.mu.Unlock()
+				return
+			}
+		case <-sub.done:
+			return
+		case <-sub.conn.Context().Done():
+			ps.mu.Lock()
+			ps.remove(sub)
+			ps.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Must be called with the lock held.
+func (ps *PubSub) remove(sub *subscriber) {
+	if ps.subscribers[sub.conn.ID] != sub {
+		return
+	}
+	delete(ps.subscribers, sub.conn.ID)
+	close(sub.done)
+}
+
+func (sub *subscriber) matches(topic string) bool {
+	for pattern := range sub.patterns {
+		if MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the topic matches the pattern.
+func MatchTopic(pattern string, topic string) bool {
+	pattern_parts := strings.Split(pattern, ".")
+	topic_parts := strings.Split(topic, ".")
+	for i, part := range pattern_parts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(topic_parts) {
+			return false
+		}
+		if part != "*" && part != topic_parts[i] {
+			return false
+		}
+	}
+	return len(pattern_parts) == len(topic_parts)
+}
+
+func validateTopic(topic string, wildcards bool) error {
+	if topic == "" {
+		return errors.New("invalid topic: no topic provided")
+	}
+	parts := strings.Split(topic, ".")
+	for i, part := range parts {
+		switch {
+		case part == "":
+			return errors.New("invalid topic: empty part in " + topic)
+		case !wildcards && (part == "*" || part == "#"):
+			return errors.New("invalid topic: wildcards can only be used to subscribe: " + topic)
+		case part == "#" && i != len(parts)-1:
+			return errors.New("invalid topic: # must be the last part: " + topic)
+		}
+	}
+	return nil
+}
+
+// Subscribe to the topics matching the pattern.
+// The handler receives the published messages, with the topic in the TOPIC header.
+func (c *Client) Subscribe(pattern string, handler func(msg *Response)) error {
+	err := validateTopic(pattern, true)
+	if err != nil {
+		return err
+	}
+	c.pending_mu.Lock()
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[string]func(msg *Response))
+	}
+	c.subscriptions[pattern] = handler
+	c.pending_mu.Unlock()
+	c.OnPush(COMMAND_PUBLISH, c.dispatchPublish)
+
+	rq := InitRequest(COMMAND_SUBSCRIBE)
+	rq.Headers["TOPIC"] = pattern
+	resp, err := c.Send(rq)
+	if err == nil {
+		err = resp.Err()
+	}
+	if err != nil {
+		c.pending_mu.Lock()
+		delete(c.subscriptions, pattern)
+		c.pending_mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Stop receiving messages for a pattern passed to Subscribe.
+func (c *Client) Unsubscribe(pattern string) error {
+	c.pending_mu.Lock()
+	delete(c.subscriptions, pattern)
+	c.pending_mu.Unlock()
+
+	rq := InitRequest(COMMAND_UNSUBSCRIBE)
+	rq.Headers["TOPIC"] = pattern
+	resp, err := c.Send(rq)
+	if err != nil {
+		return err
+	}
+	return resp.Err()
+}
+
+// Publish a message to the subscribers of the topic.
+func (c *Client) Publish(topic string, content []byte) error {
+	err := validateTopic(topic, false)
+	if err != nil {
+		return err
+	}
+	rq := InitRequest(COMMAND_PUBLISH)
+	rq.Headers["TOPIC"] = topic
+	rq.Content = content
+	resp, err := c.Send(rq)
+	if err != nil {
+		return err
+	}
+	return resp.Err()
+}
+
+func (c *Client) dispatchPublish(msg *Response) {
+	topic := msg.Headers["TOPIC"]
+	handlers := make([]func(msg *Response), 0)
+	c.pending_mu.Lock()
+	for pattern, handler := range c.subscriptions {
+		if MatchTopic(pattern, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.pending_mu.Unlock()
+	for _, handler := range handlers {
+		handler(msg)
+	}
+}
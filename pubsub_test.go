@@ -0,0 +1,129 @@
+package tcpproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_MatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		matches bool
+	}{
+		{"news.sports", "news.sports", true},
+		{"news.sports", "news.weather", false},
+		{"news.*", "news.sports", true},
+		{"news.*", "news.sports.football", false},
+		{"*.sports", "news.sports", true},
+		{"news.#", "news.sports.football", true},
+		{"news.#", "news", true},
+		{"#", "news.sports", true},
+		{"news", "news.sports", false},
+	}
+	for _, test := range tests {
+		if MatchTopic(test.pattern, test.topic) != test.matches {
+			t.Errorf("MatchTopic(%q, %q) should be %v", test.pattern, test.topic, test.matches)
+		}
+	}
+
+	if err := validateTopic("news.#.sports", true); err == nil {
+		t.Error("# is only allowed as the last part")
+	}
+	if err := validateTopic("news.*", false); err == nil {
+		t.Error("Wildcards are not allowed when publishing")
+	}
+}
+
+func Test_PubSub(t *testing.T) {
+	testConfig(t, nil)
+	server := InitServer("127.0.0.1", 0, "")
+	pubsub := server.EnablePubSub()
+	pubsub.Authorize = func(rq *Request, command string, topic string) error {
+		if strings.HasPrefix(topic, "admin.") {
+			return errors.New("admin topics are not allowed")
+		}
+		return nil
+	}
+	startTestServer(t, server)
+	subscriber := connectTestClient(t, server, nil)
+	publisher := connectTestClient(t, server, nil)
+
+	received := make(chan string, 10)
+	err := subscriber.Subscribe("news.*", func(msg *Response) {
+		received <- msg.Headers["TOPIC"] + ":" + string(msg.Content)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("news.sports", []byte("goal")); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("weather.today", []byte("rain")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if msg != "news.sports:goal" {
+			t.Error("Wrong message received: " + msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Published message not received")
+	}
+
+	err = subscriber.Unsubscribe("news.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pubsub.Subscribers() != 0 {
+		t.Error("Subscriber was not removed")
+	}
+	publisher.Publish("news.sports", []byte("goal"))
+	select {
+	case msg := <-received:
+		t.Error("Message received after unsubscribing: " + msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Refused by the Authorize hook
+	var status_err *StatusError
+	err = publisher.Publish("admin.users", []byte("drop"))
+	if !errors.As(err, &status_err) || status_err.Status != STATUS_FORBIDDEN {
+		t.Errorf("Publishing to a forbidden topic was allowed: %v", err)
+	}
+	err = subscriber.Subscribe("admin.#", func(msg *Response) {})
+	if !errors.As(err, &status_err) || status_err.Status != STATUS_FORBIDDEN {
+		t.Errorf("Subscribing to a forbidden topic was allowed: %v", err)
+	}
+}
+
+func Test_PubSub_SlowSubscriber(t *testing.T) {
+	ps := &PubSub{
+		BufferSize:  1,
+		subscribers: make(map[string]*subscriber),
+	}
+	server_conn, client_conn := net.Pipe()
+	defer client_conn.Close()
+	sc := initServerConn(server_conn)
+	err := ps.Subscribe(sc, "news.#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing reads the connection, the writer blocks on the first message and the second fills the buffer
+	for i := 0; i < 3; i++ {
+		ps.Publish("news.sports", InitResponse())
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ps.Subscribers() != 0 {
+		t.Error("Slow subscriber was not removed")
+	}
+	client_conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadAll(client_conn)
+	if err != nil {
+		t.Error("Slow subscriber was not disconnected: " + err.Error())
+	}
+}
@@ -0,0 +1,90 @@
+package tcpproto
+
+import (
+	"errors"
+)
+
+var errNotSecure = errors.New("connection did not finish the secure handshake")
+
+// Send a message to a connected client, without it having asked for one.
+// The client hands it to the handler registered with OnPush for the COMMAND of the message.
+func (s *Server) Push(connID string, msg *Response) error {
+	sc, ok := s.Conn(connID)
+	if !ok {
+		return errors.New("connection not found: " + connID)
+	}
+	msg.Headers["MESSAGE_TYPE"] = MESSAGE_TYPE_PUSH
+	frame, err := msg.generate()
+	if err != nil {
+		return err
+	}
+	return s.writePush(sc, frame)
+}
+
+// Push a message to every connected client.
+// Clients which did not finish the secure handshake are skipped when the server is Secure.
+// Returns the last error, after trying every client.
+func (s *Server) Broadcast(msg *Response) error {
+	msg.Headers["MESSAGE_TYPE"] = MESSAGE_TYPE_PUSH
+	frame, err := msg.generate()
+	if err != nil {
+		return err
+	}
+	var last_err error
+	for _, id := range s.Conns() {
+		sc, ok := s.Conn(id)
+		if !ok {
+			continue
+		}
+		err := s.writePush(sc, frame)
+		if errors.Is(err, errNotSecure) {
+			continue
+		}
+		if err != nil {
+			CONF.LOGGER.Error("error pushing to " + id + ": " + err.Error())
+			last_err = err
+		}
+	}
+	return last_err
+}
+
+// Write a push, which is never sent in plaintext when the server is Secure.
+func (s *Server) writePush(sc *ServerConn, frame []byte) error {
+	sc.write_mu.Lock()
+	defer sc.write_mu.Unlock()
+	// The secure handshake sets up the encryption while holding the lock
+	if s.Secure && sc.secure == nil {
+		return errNotSecure
+	}
+	_, err := sc.conn().Write(frame)
+	return err
+}
+
+// Register a handler for messages pushed by the server with the COMMAND.
+// Handlers are called one at a time in the order the messages arrived,
+// use "" to handle pushes without a registered handler.
+// While CONF.PUSH_BUFFER_SIZE pushes wait for the handlers, further pushes are dropped.
+func (c *Client) OnPush(command string, handler func(msg *Response)) {
+	c.pending_mu.Lock()
+	defer c.pending_mu.Unlock()
+	if c.push_handlers == nil {
+		c.push_handlers = make(map[string]func(msg *Response))
+	}
+	c.push_handlers[command] = handler
+}
+
+func (c *Client) handlePushes(pushes chan *Response) {
+	for msg := range pushes {
+		c.pending_mu.Lock()
+		handler, ok := c.push_handlers[msg.Headers["COMMAND"]]
+		if !ok {
+			handler, ok = c.push_handlers[""]
+		}
+		c.pending_mu.Unlock()
+		if !ok {
+			CONF.LOGGER.Debug("No push handler for command: " + msg.Headers["COMMAND"])
+			continue
+		}
+		handler(msg)
+	}
+}
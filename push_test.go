@@ -0,0 +1,227 @@
+package tcpproto
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Push(t *testing.T) {
+	testConfig(t, func(conf *Config) { conf.PUSH_BUFFER_SIZE = 2 })
+	server := InitServer("127.0.0.1", 0, "")
+	server.AddCallback("NOTIFY", func(rq *Request, resp *Response) {
+		// The push is sent before the response, and must not be taken for it
+		msg := InitResponse("NEWS")
+		msg.Content = []byte("pushed")
+		if err := server.Push(rq.ConnID, msg); err != nil {
+			t.Error(err)
+		}
+		resp.Content = []byte("response")
+	})
+	server.AddCallback("FLOOD", func(rq *Request, resp *Response) {
+		for i := 0; i < 10; i++ {
+			server.Push(rq.ConnID, InitResponse("SLOW"))
+		}
+	})
+	server.AddCallback("PING", func(rq *Request, resp *Response) {
+		resp.Content = []byte("pong")
+	})
+	startTestServer(t, server)
+
+	connect := func(news chan string) *Client {
+		return connectTestClient(t, server, func(client *Client) {
+			client.OnPush("NEWS", func(msg *Response) {
+				news <- string(msg.Content)
+			})
+		})
+	}
+	receive := func(news chan string) string {
+		select {
+		case msg := <-news:
+			return msg
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	news := make(chan string, 10)
+	client := connect(news)
+	resp, err := client.Send(InitRequest("NOTIFY"))
+	if err != nil || string(resp.Content) != "response" {
+		t.Fatalf("Wrong response: %v %q", err, resp.Content)
+	}
+	if msg := receive(news); msg != "pushed" {
+		t.Errorf("Push not received: %q", msg)
+	}
+
+	// Broadcast to every connected client
+	other_news := make(chan string, 10)
+	other := connect(other_news)
+	if _, err := other.Send(InitRequest("PING")); err != nil {
+		t.Fatal(err)
+	}
+	msg := InitResponse("NEWS")
+	msg.Content = []byte("broadcast")
+	if err := server.Broadcast(msg); err != nil {
+		t.Error(err)
+	}
+	if msg := receive(news); msg != "broadcast" {
+		t.Errorf("Broadcast not received: %q", msg)
+	}
+	if msg := receive(other_news); msg != "broadcast" {
+		t.Errorf("Broadcast not received by the other client: %q", msg)
+	}
+
+	// A blocked push handler does not hold up responses
+	blocked := make(chan struct{})
+	defer close(blocked)
+	client.OnPush("SLOW", func(msg *Response) {
+		<-blocked
+	})
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Send(InitRequest("FLOOD"))
+		if err == nil {
+			_, err = client.Send(InitRequest("PING"))
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Responses were held up by a blocked push handler")
+	}
+}
+
+func Test_Push_Secure(t *testing.T) {
+	testConfig(t, nil)
+	server := InitServer("127.0.0.1", 0, "")
+	server.PRIVKEY = ImportPrivate_PEM_Key("PRIVKEY.pem")
+	server.Secure = true
+	conn_id := make(chan string, 1)
+	server.AddCallback("ID", func(rq *Request, resp *Response) {
+		conn_id <- rq.ConnID
+	})
+	startTestServer(t, server)
+
+	news := make(chan string, 10)
+	client := connectTestClient(t, server, func(client *Client) {
+		client.PUBKEY = ImportPublic_PEM_Key("PUBKEY.pem")
+		client.Secure = true
+		client.OnPush("NEWS", func(msg *Response) {
+			news <- string(msg.Content)
+		})
+	})
+	if _, err := client.Send(InitRequest("ID")); err != nil {
+		t.Fatal(err)
+	}
+	secure_id := <-conn_id
+
+	// A connection which never started the secure handshake
+	plain, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	var plain_id string
+	for i := 0; i < 50 && plain_id == ""; i++ {
+		for _, id := range server.Conns() {
+			if id != secure_id {
+				plain_id = id
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if plain_id == "" {
+		t.Fatal("Connection was not accepted")
+	}
+
+	msg := InitResponse("NEWS")
+	msg.Content = []byte("secret")
+	if err := server.Push(plain_id, msg); err == nil {
+		t.Error("Pushed to a connection which is not encrypted")
+	}
+	if err := server.Broadcast(msg); err != nil {
+		t.Error(err)
+	}
+	select {
+	case msg := <-news:
+		if msg != "secret" {
+			t.Errorf("Wrong broadcast received: %q", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("Broadcast not received by the encrypted client")
+	}
+	plain.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _ := plain.Read(make([]byte, 64)); n > 0 {
+		t.Error("Broadcast was sent in plaintext")
+	}
+}
+
+func Test_Push_BeforeHandshake(t *testing.T) {
+	testConfig(t, func(conf *Config) { conf.Use_Handshake = true })
+	server := InitServer("127.0.0.1", 0, "")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// A server which pushes before it answers the hello
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		rq, resp, err := server.parseRequest(conn, reader)
+		if err != nil {
+			return
+		}
+		push := InitResponse("NEWS")
+		push.Headers["MESSAGE_TYPE"] = MESSAGE_TYPE_PUSH
+		push.Content = []byte("early")
+		conn.Write(push.Generate())
+		server.Hello(rq, resp)
+		conn.Write(server.responseFrame(resp))
+		_, resp, err = server.parseRequest(conn, reader)
+		if err != nil {
+			return
+		}
+		resp.Content = []byte("pong")
+		conn.Write(server.responseFrame(resp))
+		reader.ReadByte()
+	}()
+
+	news := make(chan string, 1)
+	client := InitClient("127.0.0.1", ln.Addr().(*net.TCPAddr).Port, "")
+	client.OnPush("NEWS", func(msg *Response) {
+		news <- string(msg.Content)
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if !client.HasFeature(FEATURE_MULTIPLEX) {
+		t.Error("Push was taken for the hello reply")
+	}
+	resp, err := client.Send(InitRequest("PING"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Content) != "pong" {
+		t.Errorf("Wrong response after the handshake: %q", resp.Content)
+	}
+	select {
+	case msg := <-news:
+		if msg != "early" {
+			t.Errorf("Wrong push received: %q", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("Push received during the handshake was dropped")
+	}
+}
@@ -1,9 +1,11 @@
 package tcpproto
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"net"
-	"strconv"
+	"strings"
 )
 
 type User struct {
@@ -17,13 +19,20 @@ type User struct {
 }
 
 type Request struct {
-	Headers            map[string]string
+	Message
+	ctx                context.Context
 	Vault              map[string]string
-	Content            []byte
-	File               *FileData
 	Data               map[string]string
+	Signed             map[string]string
+	VaultErrors        map[string]error
 	User               *User
 	Conn               net.Conn
+	ConnID             string
+	TLS                *tls.ConnectionState
+	cookies            *Cookies
+	session            *Session
+	session_store      SessionStore
+	session_id         string
 	system_information *SysInfo
 }
 
@@ -37,18 +46,14 @@ func InitRequest(args ...string) *Request {
 
 func initReqPlain() *Request {
 	rq := &Request{
-		Headers: make(map[string]string),
+		Message: initMessage(),
 		Vault:   make(map[string]string),
-		Content: []byte{},
-		File: &FileData{
-			Name:     "",
-			Size:     0,
-			Boundary: "",
-			Present:  false,
-			Content:  []byte{},
-		},
-		Data: make(map[string]string),
-		User: &User{},
+		Data:    make(map[string]string),
+		Signed:  make(map[string]string),
+		cookies: InitCookies(),
+		User:    &User{},
+
+		VaultErrors: make(map[string]error),
 	}
 	return rq
 }
@@ -58,12 +63,19 @@ func initReqWithArgs(command string) *Request {
 	return rq
 }
 
+// Send a cookie with the request.
+// Vault and signed values are sent under their VAULT- and SIGNED- names, so the server can check them.
 func (rq *Request) AddCookie(key string, value string) {
-	rq.Headers[key] = value
+	if strings.HasPrefix(key, "VAULT-") || strings.HasPrefix(key, "SIGNED-") {
+		rq.Headers[key] = value
+		return
+	}
+	rq.Headers["REMEMBER-"+key] = value
 }
 
-func (rq *Request) AddHeader(key string, value string) {
-	rq.Headers[key] = value
+// Get a cookie the client sent, nil if it was not sent.
+func (rq *Request) Cookie(name string) *Cookie {
+	return rq.cookies.GetCookie(name)
 }
 
 func (rq *Request) DecryptVault() map[string]string {
@@ -77,6 +89,22 @@ func (rq *Request) DecryptVault() map[string]string {
 	return rq.Vault
 }
 
+// The context of the connection the request came in on, cancelled when the server closes the connection.
+// Callbacks run on the goroutine reading the connection,
+// so a client disconnecting is only noticed after the callback returns.
+// Stream handlers run on their own, and do see the client disconnect.
+func (rq *Request) Context() context.Context {
+	if rq.ctx == nil {
+		return context.Background()
+	}
+	return rq.ctx
+}
+
+func (rq *Request) WithContext(ctx context.Context) *Request {
+	rq.ctx = ctx
+	return rq
+}
+
 func (rq *Request) SysInfo() *SysInfo {
 	if rq.system_information != nil {
 		return rq.system_information
@@ -96,49 +124,6 @@ func (rq *Request) MacAddr() string {
 	return rq.SysInfo().MacAddr
 }
 
-func (rq *Request) AddFile(filename string, file []byte, boundary string) {
-	rq.File.Name = filename
-	rq.File.Size = len(file)
-	rq.File.Content = file
-	rq.File.Present = true
-	rq.File.Boundary = boundary
-}
-
-func (rq *Request) ContentLength() int {
-	content := rq.Content
-	if rq.File.Present {
-		content = append(rq.File.EndBoundary(), content...)
-		content = append(rq.File.Content, content...)
-		content = append(rq.File.StartBoundary(), content...)
-	}
-	return len(content)
-}
-
 func (rq *Request) Generate() ([]byte, error) {
-	// nowtime := time.Now()
-	// LOGGER.Debug("Starting headers")
-
-	// Generate the header
-	header := ""
-	// Set up file if present
-	content := rq.Content
-
-	if rq.File.Present {
-		rq.Headers["FILE_NAME"] = rq.File.Name
-		rq.Headers["FILE_SIZE"] = strconv.Itoa(rq.File.Size)
-		rq.Headers["FILE_BOUNDARY"] = rq.File.Boundary
-		rq.Headers["HAS_FILE"] = "true"
-		// Generate the content
-		content = append(rq.File.EndBoundary(), content...)
-		content = append(rq.File.Content, content...)
-		content = append(rq.File.StartBoundary(), content...)
-	}
-	rq.Headers["CONTENT_LENGTH"] = strconv.Itoa(len(content))
-	// Generate headers
-	for key, value := range rq.Headers {
-		header += key + ":" + value + "\r\n"
-	}
-	header += "\r\n"
-	// Generate the final request
-	return append([]byte(header), content...), nil
+	return rq.encode("")
 }
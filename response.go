@@ -1,20 +1,26 @@
 package tcpproto
 
 import (
-	"bytes"
 	"errors"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Response struct {
-	Headers   map[string]string
+	Message
 	SetValues map[string]string
+	// Attributes of the cookies in SetValues, set with SetCookie
+	Cookies   map[string]*Cookie
 	DelValues []string
 	Vault     map[string]string
-	Content   []byte
-	File      *FileData
+	Signed    map[string]string
 	Error     []error
+	// Metadata of the vault values, set with LockWith or kept from the request
+	vault_meta map[string]*VaultValue
+	// Where vault values can be bound to
+	conn_id    string
+	session_id string
 }
 
 func (resp *Response) AddError(err string) {
@@ -30,13 +36,15 @@ func InitResponse(args ...string) *Response {
 
 func initRespPlain() *Response {
 	return &Response{
-		Headers:   make(map[string]string),
+		Message:   initMessage(),
 		SetValues: make(map[string]string),
+		Cookies:   make(map[string]*Cookie),
 		DelValues: make([]string, 0),
 		Vault:     make(map[string]string),
-		Content:   make([]byte, 0),
-		File:      &FileData{},
+		Signed:    make(map[string]string),
 		Error:     make([]error, 0),
+
+		vault_meta: make(map[string]*VaultValue),
 	}
 }
 
@@ -48,9 +56,31 @@ func initRespWithArgs(command string) *Response {
 
 func (resp *Response) Lock(key string, value string) *Response {
 	resp.Vault[key] = value
+	delete(resp.vault_meta, key)
 	return resp
 }
 
+// Lock a value which expires, or is only accepted from the session or connection of the client.
+func (resp *Response) LockWith(key string, value string, opts VaultOptions) *Response {
+	resp.Vault[key] = value
+	meta := &VaultValue{Issued: time.Now(), Bind: opts.Bind}
+	if opts.TTL > 0 {
+		meta.Expires = meta.Issued.Add(opts.TTL)
+	}
+	resp.vault_meta[key] = meta
+	return resp
+}
+
+// Whether vault values of the response are bound to the session of the client.
+func (resp *Response) bindsSession() bool {
+	for key, meta := range resp.vault_meta {
+		if _, ok := resp.Vault[key]; ok && meta.Bind == BIND_SESSION {
+			return true
+		}
+	}
+	return false
+}
+
 func (resp *Response) GetVault(key string) (string, bool) {
 	vault, ok := resp.Vault[key]
 	return vault, ok
@@ -61,6 +91,17 @@ func (resp *Response) Remember(k string, v string) *Response {
 	return resp
 }
 
+// Remember a cookie with its attributes, like the expiry and scope.
+func (resp *Response) SetCookie(cookie *Cookie) *Response {
+	if strings.ContainsAny(cookie.Name+cookie.Scope, ";:\r\n") {
+		CONF.LOGGER.Error("invalid cookie name or scope: " + cookie.Name)
+		return resp
+	}
+	resp.SetValues[cookie.Name] = cookie.Value
+	resp.Cookies[cookie.Name] = cookie
+	return resp
+}
+
 func (resp *Response) Forget(key string) *Response {
 	resp.DelValues = append(resp.DelValues, key)
 	return resp
@@ -70,24 +111,19 @@ func (resp *Response) ForgetVault(key string) {
 	resp.DelValues = append(resp.DelValues, "VAULT-"+key)
 }
 
-func (resp *Response) AddFile(filename string, file []byte, boundary string) {
-	resp.File.Name = filename
-	resp.File.Size = len(file)
-	resp.File.Content = file
-	resp.File.Present = true
-	resp.File.Boundary = boundary
-}
-
 func (resp *Response) DecodeHeaders(headers map[string]string) (map[string]string, []string, error) {
 	// Get cookie values
 	forget := make([]string, 0)
 	for k, v := range headers {
 		if strings.HasPrefix(k, "REMEMBER-") {
-			// Split the key and value
-			key := strings.ReplaceAll(k, "REMEMBER-", "")
-			resp.SetValues[key] = v
+			// Split the name from the attributes
+			cookie := parseCookieHeader(strings.TrimPrefix(k, "REMEMBER-"), v)
+			resp.SetValues[cookie.Name] = v
+			if cookie.hasAttributes() {
+				resp.Cookies[cookie.Name] = cookie
+			}
 			delete(headers, k)
-		} else if strings.HasPrefix(k, "VAULT-") {
+		} else if strings.HasPrefix(k, "VAULT-") || strings.HasPrefix(k, "SIGNED-") {
 			resp.SetValues[k] = v
 			delete(headers, k)
 		} else if strings.HasPrefix(k, "FORGET-") {
@@ -104,85 +140,78 @@ func (resp *Response) DecodeHeaders(headers map[string]string) (map[string]strin
 	return resp.SetValues, forget, nil
 }
 
-func (resp *Response) ContentLength() int {
-	if resp.File.Present {
-		return len(resp.File.Content) + len(resp.File.StartBoundary()) + len(resp.File.EndBoundary()) + len(resp.Content)
-	}
-	return len(resp.Content)
-	//content := resp.Content
-	//if resp.File.Present {
-	//	content = append(resp.File.EndBoundary(), content...)
-	//	content = append(resp.File.Content, content...)
-	//	content = append(resp.File.StartBoundary(), content...)
-	//}
-	//return len(content)
-}
-
+// Generate the frame of the response, it is empty when the response could not be encoded.
 func (resp *Response) Generate() []byte {
-	// Set up file if present
-	content := resp.Content
-	if resp.File.Present {
-		resp.Headers["FILE_NAME"] = resp.File.Name
-		resp.Headers["FILE_SIZE"] = strconv.Itoa(resp.File.Size)
-		resp.Headers["FILE_BOUNDARY"] = resp.File.Boundary
-		resp.Headers["HAS_FILE"] = "true"
-		content = append(resp.File.EndBoundary(), content...)
-		content = append(resp.File.Content, content...)
-		content = append(resp.File.StartBoundary(), content...)
+	frame, err := resp.generate()
+	if err != nil {
+		CONF.LOGGER.Error("error generating response: " + err.Error())
 	}
+	return frame
+}
 
-	// Add content length
-	resp.Headers["CONTENT_LENGTH"] = strconv.Itoa(resp.ContentLength())
-
-	// Generate the header
-	header := resp.GenHeader()
-
-	// Add header to content
-	content = append([]byte(header), content...)
-	return content
+func (resp *Response) generate() ([]byte, error) {
+	return resp.encode(resp.genValueHeader())
 }
 
 func (resp *Response) GenHeader() string {
-	// Add headers
+	return resp.genHeader(resp.genValueHeader())
+}
+
+// Generate the header lines for the values stored client side.
+func (resp *Response) genValueHeader() string {
 	// Generate the header
 	headerchan := make(chan string)
 	header := ""
 
-	go func(headers map[string]string, hchan chan string) {
-		head := ""
-		for key, value := range headers {
-			head += key + ":" + value + "\r\n"
-		}
-		headerchan <- head
-	}(resp.Headers, headerchan)
-
-	go func(headers map[string]string, hchan chan string) {
+	go func(headers map[string]string, cookies map[string]*Cookie, hchan chan string) {
 		// Write "cookie" values onto the header
 		head := ""
 		index := 0
 		for key, value := range headers {
 			index += 1
 			// value = base64.StdEncoding.EncodeToString([]byte(value))
-			head += "REMEMBER-" + key + ":" + value + "\r\n"
+			attributes := ""
+			if cookie, ok := cookies[key]; ok {
+				attributes = cookie.encodeAttributes()
+			}
+			head += "REMEMBER-" + key + attributes + ":" + value + "\r\n"
 		}
 		headerchan <- head
-	}(resp.SetValues, headerchan)
+	}(resp.SetValues, resp.Cookies, headerchan)
 
-	go func(headers map[string]string, hchan chan string) {
+	go func(headers map[string]string, meta map[string]*VaultValue, hchan chan string) {
 		// Write to the vault
 		head := ""
-		index := 0
 		for key, value := range headers {
-			index += 1
-			// Encrypt the vault key and value
-			val, err := CONF.GenVault(key, value)
+			// Encrypt the vault key and value, keeping the metadata of values sent again
+			v := &VaultValue{Key: key, Value: value}
+			if m, ok := meta[key]; ok {
+				v.Issued, v.Expires, v.Bind = m.Issued, m.Expires, m.Bind
+			}
+			switch v.Bind {
+			case BIND_SESSION:
+				v.BoundID = resp.session_id
+			case BIND_CONNECTION:
+				v.BoundID = resp.conn_id
+			}
+			val, err := CONF.SealVault(v)
 			if err != nil {
+				CONF.LOGGER.Error(err.Error())
 				continue
 			}
 			head += "VAULT-" + key + ":" + val + "\r\n"
 		}
 		headerchan <- head
-	}(resp.Vault, headerchan)
+	}(resp.Vault, resp.vault_meta, headerchan)
+
+	go func(headers map[string]string, hchan chan string) {
+		// Sign the values, they are sent readable
+		head := ""
+		for key, value := range headers {
+			head += "SIGNED-" + key + ":" + CONF.SignValue(key, value) + "\r\n"
+		}
+		headerchan <- head
+	}(resp.Signed, headerchan)
 
 	go func(headers []string, hchan chan string) {
 		head := ""
@@ -201,100 +230,9 @@ func (resp *Response) GenHeader() string {
 	// Close the channel
 	close(headerchan)
 
-	return header + "\r\n"
+	return header
 }
 
 func (resp *Response) Bytes() []byte {
 	return resp.Generate()
 }
-
-func (resp *Response) ParseFile() error {
-	// Check if data includes a file
-	has_file, ok := resp.Headers["HAS_FILE"]
-	if ok {
-		has_file, err := strconv.ParseBool(has_file)
-		if err == nil {
-			if has_file {
-				// Read the file
-				file_name, ok := resp.Headers["FILE_NAME"]
-				if !ok {
-					err := errors.New("file name not found")
-					CONF.LOGGER.Error(err.Error())
-					return err
-				}
-				file_size, ok := resp.Headers["FILE_SIZE"]
-				if !ok {
-					err := errors.New("file size not found")
-					CONF.LOGGER.Error(err.Error())
-					return err
-				}
-				file_boundary, ok := resp.Headers["FILE_BOUNDARY"]
-				if !ok {
-					err := errors.New("file boundary not found")
-					CONF.LOGGER.Error(err.Error())
-					return err
-				}
-				file_size_int, err := strconv.Atoi(file_size)
-				if err != nil {
-					err := errors.New("invalid file size")
-					CONF.LOGGER.Error(err.Error())
-					return err
-				}
-				// Set up file
-				resp.File.Name = file_name
-				resp.File.Size = file_size_int
-				resp.File.Boundary = file_boundary
-				// Parse and remove file from request.Content
-				_, err = resp.ParseFileData()
-				if err != nil {
-					// resp.Errors = append(resp.Errors, err)
-					CONF.LOGGER.Error(err.Error())
-					return err
-				}
-			}
-		}
-	}
-	return nil
-}
-
-func (resp *Response) ParseFileData() ([]byte, error) {
-	// Set up the file boundary for parsing
-	start_boundary := []byte("--" + resp.File.Boundary + "--")
-	end_boundary := []byte("----" + resp.File.Boundary + "----")
-	// Verify that the starting boundary is in the message
-	start_index := bytes.Index(resp.Content, start_boundary)
-	if start_index == -1 {
-		// err := errors.New("file starting boundary not found")
-		// resp.Errors = append(resp.Errors, err)
-		return nil, nil
-	}
-	// Verify that the ending boundary is in the message
-	end_index := bytes.Index(resp.Content, end_boundary)
-	if end_index == -1 {
-		// err := errors.New("file ending boundary not found")
-		// resp.Errors = append(resp.Errors, err)
-		return nil, nil
-	}
-	// Verify that start index is before end index
-	if end_index < start_index {
-		err := errors.New("file ending boundary before starting boundary")
-		// resp.Errors = append(resp.Errors, err)
-		return nil, err
-	}
-	// Extract the file data from the request.Content
-	file := resp.Content[start_index+len(start_boundary) : end_index]
-	if len(file) != resp.File.Size {
-		err := errors.New("file size does not match")
-		// resp.Errors = append(resp.Errors, err)
-		return nil, err
-	}
-	// Remove the file and boundaries from the content
-	resp.Content = bytes.Replace(resp.Content, end_boundary, []byte(""), 1)
-	resp.Content = bytes.Replace(resp.Content, start_boundary, []byte(""), 1)
-	resp.Content = bytes.Replace(resp.Content, file, []byte(""), -1)
-	resp.Content = bytes.TrimLeft(resp.Content, "\n")
-	// Set the file data
-	resp.File.Present = true
-	resp.File.Content = file
-	return file, nil
-}
@@ -0,0 +1,144 @@
+package tcpproto
+
+import (
+	"context"
+	"errors"
+	"go/token"
+	"reflect"
+)
+
+var (
+	type_context = reflect.TypeOf((*context.Context)(nil)).Elem()
+	type_error   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Register the exported methods of a service as commands, named "Service.Method".
+// Methods need to look like:
+//
+//	func (s *Service) Method(ctx context.Context, args *Args) (*Reply, error)
+//
+// Args and Reply need to be exported or builtin types, and the reply a pointer, as with net/rpc.
+// Args are decoded and validated like the payload of a typed handler,
+// and the reply is encoded in the content type of the request.
+// Methods which do not fit are skipped, an error is returned if none fit.
+func (s *Server) RegisterService(name string, service any) error {
+	value := reflect.ValueOf(service)
+	typ := value.Type()
+	registered := 0
+	for i := 0; i < typ.NumMethod(); i++ {
+		method := typ.Method(i)
+		if err := checkServiceMethod(method.Type); err != nil {
+			CONF.LOGGER.Debug("Skipping method " + name + "." + method.Name + ": " + err.Error())
+			continue
+		}
+		s.AddCallback(name+"."+method.Name, serviceCallback(s, value.Method(i)))
+		registered++
+	}
+	if registered == 0 {
+		return errors.New("service " + name + " has no suitable methods")
+	}
+	return nil
+}
+
+// func(receiver, context.Context, Args) (*Reply, error)
+func checkServiceMethod(typ reflect.Type) error {
+	if typ.NumIn() != 3 || typ.NumOut() != 2 {
+		return errors.New("not a service method")
+	}
+	if typ.In(1) != type_context || typ.Out(1) != type_error {
+		return errors.New("not a service method")
+	}
+	if !isExportedOrBuiltin(typ.In(2)) {
+		return errors.New("args type " + typ.In(2).String() + " not exported")
+	}
+	if typ.Out(0).Kind() != reflect.Pointer {
+		return errors.New("reply type " + typ.Out(0).String() + " not a pointer")
+	}
+	if !isExportedOrBuiltin(typ.Out(0)) {
+		return errors.New("reply type " + typ.Out(0).String() + " not exported")
+	}
+	return nil
+}
+
+// Whether the type, or the type it points to, is exported or builtin.
+func isExportedOrBuiltin(typ reflect.Type) bool {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	// Builtin types have no package path
+	return token.IsExported(typ.Name()) || typ.PkgPath() == ""
+}
+
+func serviceCallback(s *Server, method reflect.Value) func(rq *Request, resp *Response) {
+	args_type := method.Type().In(1)
+	return func(rq *Request, resp *Response) {
+		// Allocate the arguments, decoding into a pointer to them
+		var args reflect.Value
+		if args_type.Kind() == reflect.Pointer {
+			args = reflect.New(args_type.Elem())
+		} else {
+			args = reflect.New(args_type)
+		}
+		if len(rq.Content) > 0 {
+			err := rq.Decode(args.Interface())
+			if err != nil {
+				writeDecodeError(resp, err)
+				return
+			}
+		}
+		err := s.Validate(args.Interface())
+		if err != nil {
+			writeValidationError(resp, err)
+			return
+		}
+		if args_type.Kind() != reflect.Pointer {
+			args = args.Elem()
+		}
+		out := method.Call([]reflect.Value{reflect.ValueOf(rq.Context()), args})
+		if err, _ := out[1].Interface().(error); err != nil {
+			writeHandlerError(resp, err)
+			return
+		}
+		err = resp.Encode(out[0].Interface())
+		if err != nil {
+			resp.SetError(STATUS_INTERNAL_ERROR, "invalid response content: "+err.Error())
+		}
+	}
+}
+
+// Call a method of a service registered with Server.RegisterService, like "Users.Create".
+// Args are encoded in the content type of the client, and the reply is decoded into reply.
+// Error responses are returned as a *StatusError.
+func (c *Client) Call(method string, args any, reply any) error {
+	return c.call(context.Background(), method, c.contentType(), args, reply)
+}
+
+// Call a method of a service, and stop waiting for the reply when the context is done.
+// See Call.
+func (c *Client) CallContext(ctx context.Context, method string, args any, reply any) error {
+	return c.call(ctx, method, c.contentType(), args, reply)
+}
+
+func (c *Client) call(ctx context.Context, command string, content_type string, args any, reply any) error {
+	rq := InitRequest(command)
+	rq.Headers["CONTENT_TYPE"] = content_type
+	err := rq.Encode(args)
+	if err != nil {
+		return err
+	}
+	resp, err := c.SendContext(ctx, rq)
+	if err != nil {
+		return err
+	}
+	err = resp.Err()
+	if err != nil {
+		return err
+	}
+	if reply != nil && len(resp.Content) > 0 {
+		err = resp.Decode(reply)
+		if err != nil {
+			return errors.New("invalid response content: " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package tcpproto
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type RPCArgs struct {
+	A int `json:"a"`
+	B int `json:"b" validate:"min=1"`
+}
+
+type RPCReply struct {
+	Quotient int `json:"quotient"`
+}
+
+type rpcArgs struct{}
+
+type rpcArith struct{}
+
+func (a *rpcArith) Divide(ctx context.Context, args *RPCArgs) (*RPCReply, error) {
+	return &RPCReply{Quotient: args.A / args.B}, nil
+}
+
+func (a *rpcArith) Double(ctx context.Context, n int) (*int, error) {
+	double := n * 2
+	return &double, nil
+}
+
+// Not a pointer reply
+func (a *rpcArith) Value(ctx context.Context, args *RPCArgs) (RPCReply, error) {
+	return RPCReply{}, nil
+}
+
+// Not an exported args type
+func (a *rpcArith) Hidden(ctx context.Context, args *rpcArgs) (*RPCReply, error) {
+	return &RPCReply{}, nil
+}
+
+// Not a service method
+func (a *rpcArith) Reset() {}
+
+func Test_RegisterService(t *testing.T) {
+	testConfig(t, nil)
+	server := InitServer("127.0.0.1", 0, "")
+	err := server.RegisterService("Arith", &rpcArith{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for command, registered := range map[string]bool{
+		"Arith.Divide": true,
+		"Arith.Double": true,
+		"Arith.Value":  false,
+		"Arith.Hidden": false,
+		"Arith.Reset":  false,
+	} {
+		if _, ok := server.Callbacks[command]; ok != registered {
+			t.Errorf("Command %s registered: %v", command, ok)
+		}
+	}
+	if err := server.RegisterService("Empty", &struct{}{}); err == nil {
+		t.Error("Service without methods was registered")
+	}
+	client := testConnect(t, server)
+
+	var reply RPCReply
+	err = client.Call("Arith.Divide", &RPCArgs{A: 7, B: 2}, &reply)
+	if err != nil || reply.Quotient != 3 {
+		t.Errorf("Wrong reply: %d %v", reply.Quotient, err)
+	}
+	var double int
+	err = client.Call("Arith.Double", 21, &double)
+	if err != nil || double != 42 {
+		t.Errorf("Wrong reply: %d %v", double, err)
+	}
+	err = client.Call("Arith.Divide", &RPCArgs{A: 7}, &reply)
+	var status_err *StatusError
+	if !errors.As(err, &status_err) || status_err.Status != STATUS_BAD_REQUEST {
+		t.Errorf("Invalid args not refused: %v", err)
+	}
+}
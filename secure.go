@@ -0,0 +1,273 @@
+package tcpproto
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Sent by the client to start the encrypted session, before any other message.
+// The client sends its ephemeral X25519 key in SECURE_KEY, the server answers with its own,
+// and a signature over both keys in SECURE_SIGNATURE, made with the RSA key of the server.
+// Everything sent after the answer is encrypted.
+const MESSAGE_TYPE_SECURE_HELLO = "SECURE_HELLO"
+
+// Largest plaintext in a single encrypted record, larger writes are split.
+const secureRecordSize = 64 * KILOBYTE
+
+var ErrSecureHandshake = errors.New("secure handshake failed")
+
+// Keys of the encrypted session, one for each direction.
+type secureKeys struct {
+	client *[32]byte
+	server *[32]byte
+}
+
+// Both keys, in the order they were sent, signed by the server.
+func secureTranscript(client_key []byte, server_key []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte("tcpproto secure handshake"))
+	hash.Write(client_key)
+	hash.Write(server_key)
+	return hash.Sum(nil)
+}
+
+// Derive the keys of the session from the shared secret of the key exchange.
+func deriveSecureKeys(private []byte, peer []byte, transcript []byte) (*secureKeys, error) {
+	shared, err := curve25519.X25519(private, peer)
+	if err != nil {
+		return nil, err
+	}
+	return &secureKeys{
+		client: DeriveKey(shared, transcript, "tcpproto secure client"),
+		server: DeriveKey(shared, transcript, "tcpproto secure server"),
+	}, nil
+}
+
+// Ephemeral X25519 key pair, a new one is made for every connection.
+func newExchangeKey() ([]byte, []byte, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(private)
+	if err != nil {
+		return nil, nil, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return private, public, nil
+}
+
+func newAEAD(key *[32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// secureConn encrypts everything written to the connection in records,
+// each sealed with AES-256-GCM and prefixed with its length.
+// The nonce of a record is its sequence number, so records which are replayed,
+// reordered or dropped cannot be opened, and the connection fails.
+type secureConn struct {
+	net.Conn
+	// Reads from the connection, data buffered before the session started is not lost
+	reader    io.Reader
+	seal      cipher.AEAD
+	open      cipher.AEAD
+	write_mu  sync.Mutex
+	write_seq uint64
+	read_seq  uint64
+	// Opened data which has not been read yet
+	read_buf []byte
+}
+
+func newSecureConn(conn net.Conn, reader io.Reader, seal_key *[32]byte, open_key *[32]byte) (*secureConn, error) {
+	seal, err := newAEAD(seal_key)
+	if err != nil {
+		return nil, err
+	}
+	open, err := newAEAD(open_key)
+	if err != nil {
+		return nil, err
+	}
+	return &secureConn{
+		Conn:   conn,
+		reader: reader,
+		seal:   seal,
+		open:   open,
+	}, nil
+}
+
+func recordNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+func (s *secureConn) Write(p []byte) (int, error) {
+	s.write_mu.Lock()
+	defer s.write_mu.Unlock()
+	written := 0
+	for written < len(p) {
+		end := written + secureRecordSize
+		if end > len(p) {
+			end = len(p)
+		}
+		// The length is authenticated along with the record
+		record := make([]byte, 4, 4+end-written+s.seal.Overhead())
+		binary.BigEndian.PutUint32(record, uint32(end-written+s.seal.Overhead()))
+		record = s.seal.Seal(record, recordNonce(s.seal, s.write_seq), p[written:end], record[:4])
+		s.write_seq++
+		_, err := s.Conn.Write(record)
+		if err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+func (s *secureConn) Read(p []byte) (int, error) {
+	if len(s.read_buf) == 0 {
+		err := s.readRecord()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.read_buf)
+	s.read_buf = s.read_buf[n:]
+	return n, nil
+}
+
+func (s *secureConn) readRecord() error {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(s.reader, header)
+	if err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size < uint32(s.open.Overhead()) || size > uint32(secureRecordSize+s.open.Overhead()) {
+		return errors.New("invalid encrypted record size")
+	}
+	record := make([]byte, size)
+	_, err = io.ReadFull(s.reader, record)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	plaintext, err := s.open.Open(record[:0], recordNonce(s.open, s.read_seq), record, header)
+	if err != nil {
+		return errors.New("encrypted record could not be opened, it was changed, replayed or reordered")
+	}
+	s.read_seq++
+	s.read_buf = plaintext
+	return nil
+}
+
+// Answer the secure hello of the client, and encrypt the connection from here on.
+func (s *Server) secureHandshake(sc *ServerConn, rq *Request, resp *Response) error {
+	if !s.Secure || s.PRIVKEY == nil || sc.secure != nil {
+		resp.SetError(STATUS_BAD_REQUEST, "encrypted sessions are not enabled")
+		return s.sendTo(sc, resp)
+	}
+	client_key, err := base64.StdEncoding.DecodeString(rq.Headers["SECURE_KEY"])
+	if err != nil || len(client_key) != curve25519.PointSize {
+		resp.SetError(STATUS_BAD_REQUEST, "invalid SECURE_KEY")
+		return s.sendTo(sc, resp)
+	}
+	private, public, err := newExchangeKey()
+	if err != nil {
+		return err
+	}
+	transcript := secureTranscript(client_key, public)
+	keys, err := deriveSecureKeys(private, client_key, transcript)
+	if err != nil {
+		resp.SetError(STATUS_BAD_REQUEST, "invalid SECURE_KEY")
+		return s.sendTo(sc, resp)
+	}
+	signature, err := rsa.SignPSS(rand.Reader, s.PRIVKEY, crypto.SHA256, transcript, nil)
+	if err != nil {
+		return err
+	}
+	secure, err := newSecureConn(sc.Conn, sc.reader, keys.server, keys.client)
+	if err != nil {
+		return err
+	}
+	resp.Headers["SECURE_KEY"] = base64.StdEncoding.EncodeToString(public)
+	resp.Headers["SECURE_SIGNATURE"] = base64.StdEncoding.EncodeToString(signature)
+
+	// Nothing may be written between the answer and the start of the session
+	sc.write_mu.Lock()
+	defer sc.write_mu.Unlock()
+	_, err = sc.Conn.Write(s.responseFrame(resp))
+	if err != nil {
+		return err
+	}
+	sc.secure = secure
+	sc.reader = bufio.NewReaderSize(secure, CONF.BUFF_SIZE)
+	return nil
+}
+
+// Start the encrypted session, the server is verified with the public key of the client.
+func (c *Client) secureHandshake() error {
+	if c.PUBKEY == nil {
+		return errors.New("the public key of the server is needed for an encrypted session")
+	}
+	private, public, err := newExchangeKey()
+	if err != nil {
+		return err
+	}
+	rq := InitRequest()
+	rq.Headers["MESSAGE_TYPE"] = MESSAGE_TYPE_SECURE_HELLO
+	rq.Headers["SECURE_KEY"] = base64.StdEncoding.EncodeToString(public)
+	header, _, err := c.roundTrip(context.Background(), rq)
+	if err != nil {
+		return err
+	}
+	resp := InitResponse()
+	resp.Headers = header
+	if err := resp.Err(); err != nil {
+		return err
+	}
+	server_key, err := base64.StdEncoding.DecodeString(header["SECURE_KEY"])
+	if err != nil || len(server_key) != curve25519.PointSize {
+		return ErrSecureHandshake
+	}
+	signature, err := base64.StdEncoding.DecodeString(header["SECURE_SIGNATURE"])
+	if err != nil {
+		return ErrSecureHandshake
+	}
+	transcript := secureTranscript(public, server_key)
+	err = rsa.VerifyPSS(c.PUBKEY, crypto.SHA256, transcript, signature, nil)
+	if err != nil {
+		return errors.New("secure handshake failed: the server could not be verified")
+	}
+	keys, err := deriveSecureKeys(private, server_key, transcript)
+	if err != nil {
+		return ErrSecureHandshake
+	}
+	secure, err := newSecureConn(c.Conn, c.reader, keys.client, keys.server)
+	if err != nil {
+		return err
+	}
+	c.Conn = secure
+	c.reader = bufio.NewReaderSize(secure, CONF.BUFF_SIZE)
+	return nil
+}
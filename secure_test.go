@@ -0,0 +1,88 @@
+package tcpproto
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Connection which writes into a buffer.
+type bufferConn struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (b *bufferConn) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+func Test_SecureConn_Replay(t *testing.T) {
+	key := NewEncryptionKey()
+	wire := &bytes.Buffer{}
+	writer, _ := newSecureConn(&bufferConn{buf: wire}, nil, key, key)
+	writer.Write([]byte("FIRST"))
+	first := append([]byte(nil), wire.Bytes()...)
+	writer.Write([]byte("SECOND"))
+
+	reader, _ := newSecureConn(nil, bytes.NewReader(wire.Bytes()), key, key)
+	buf := make([]byte, 16)
+	for _, want := range []string{"FIRST", "SECOND"} {
+		n, err := reader.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("Record was not opened: %v %q", err, buf[:n])
+		}
+	}
+
+	// The first record sent again
+	reader, _ = newSecureConn(nil, bytes.NewReader(append(first, first...)), key, key)
+	reader.Read(buf)
+	if _, err := reader.Read(buf); err == nil {
+		t.Error("Replayed record was opened")
+	}
+}
+
+func Test_Secure(t *testing.T) {
+	testConfig(t, nil)
+	server := InitServer("127.0.0.1", 0, "")
+	server.PRIVKEY = ImportPrivate_PEM_Key("PRIVKEY.pem")
+	server.Secure = true
+	server.AddCallback("ECHO", func(rq *Request, resp *Response) {
+		resp.Content = rq.Content
+		resp.Remember("SEEN", "true")
+	})
+	startTestServer(t, server)
+
+	client := connectTestClient(t, server, func(client *Client) {
+		client.PUBKEY = ImportPublic_PEM_Key("PUBKEY.pem")
+		client.Secure = true
+	})
+	// Larger than a single record
+	content := strings.Repeat("SECRET_CONTENT\n", 10000)
+	rq := InitRequest("ECHO")
+	rq.Content = []byte(content)
+	resp, err := client.Send(rq)
+	if err != nil || string(resp.Content) != content {
+		t.Fatalf("Encrypted request was not answered: %v", err)
+	}
+	if client.Cookies.GetCookie("SEEN") == nil {
+		t.Error("Cookie of the encrypted response was not stored")
+	}
+
+	// Connections which are not encrypted are refused
+	plain := connectTestClient(t, server, nil)
+	resp, err = plain.Send(InitRequest("ECHO"))
+	if err != nil || resp.Status() != STATUS_FORBIDDEN {
+		t.Errorf("Request which was not encrypted was answered: %v %d", err, resp.Status())
+	}
+
+	// The server is verified with its public key
+	_, other_key := GenerateKeyPair(1024)
+	impostor := InitClient(server.IP, server.Port, "")
+	impostor.Secure = true
+	impostor.PUBKEY = other_key
+	if err := impostor.Connect(); err == nil {
+		impostor.Close()
+		t.Error("Server was not verified with the public key")
+	}
+}
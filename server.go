@@ -2,6 +2,7 @@ package tcpproto
 
 import (
 	"crypto/rsa"
+	"crypto/tls"
 	"errors"
 	"net"
 	"strconv"
@@ -15,22 +16,44 @@ type Middleware struct {
 }
 
 type Server struct {
-	ln         net.Listener
-	IP         string
-	Config     *Config
-	Port       int
-	Callbacks  map[string]func(rq *Request, resp *Response)
-	Middleware []*Middleware
-	PRIVKEY    *rsa.PrivateKey
+	ln        net.Listener
+	IP        string
+	Config    *Config
+	Port      int
+	Callbacks map[string]func(rq *Request, resp *Response)
+	// Handlers for streams opened with MESSAGE_TYPE STREAM_OPEN, by COMMAND.
+	StreamHandlers map[string]func(stream *Stream) error
+	Middleware     []*Middleware
+	PRIVKEY        *rsa.PrivateKey
+	// Default content type for Request.Decode and Response.Encode,
+	// CONF.Content_Type is used when empty.
+	ContentType string
+	// Validates the payloads of typed handlers before they are called,
+	// ValidateStruct is used when nil.
+	Validator func(v any) error
+	// Publish/subscribe topics, nil until EnablePubSub is called.
+	PubSub *PubSub
+	// Chunked file transfers, nil until EnableFileTransfer is called.
+	FileTransfer *FileTransfer
+	// Stores the sessions of rq.Session(), sessions are disabled when nil.
+	Sessions SessionStore
+	// Only accept connections encrypted with the secure handshake, which is signed with PRIVKEY.
+	Secure bool
+	// Accept TLS connections, see StartTLS.
+	TLSConfig *tls.Config
+	conns     map[string]*ServerConn
+	conns_mu  sync.RWMutex
 }
 
 func InitServer(ip string, port int, privkey_file string) *Server {
 	srv := &Server{
-		IP:         ip,
-		Port:       port,
-		Callbacks:  make(map[string]func(rq *Request, resp *Response)),
-		Middleware: []*Middleware{},
-		PRIVKEY:    nil,
+		IP:             ip,
+		Port:           port,
+		Callbacks:      make(map[string]func(rq *Request, resp *Response)),
+		StreamHandlers: make(map[string]func(stream *Stream) error),
+		Middleware:     []*Middleware{},
+		PRIVKEY:        nil,
+		conns:          make(map[string]*ServerConn),
 	}
 	if CONF.Use_Crypto && privkey_file != "" {
 		srv.PRIVKEY = ImportPrivate_PEM_Key(privkey_file)
@@ -45,7 +68,11 @@ func (s *Server) Addr() string {
 
 func (s *Server) Start() error {
 	var err error
-	s.ln, err = net.Listen("tcp", s.Addr())
+	if s.TLSConfig != nil {
+		s.ln, err = tls.Listen("tcp", s.Addr(), s.TLSConfig)
+	} else {
+		s.ln, err = net.Listen("tcp", s.Addr())
+	}
 	if err != nil {
 		return err
 	}
@@ -67,45 +94,140 @@ func (s *Server) Serve() error {
 }
 
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
-	wg := &sync.WaitGroup{}
+	sc := s.addConn(conn)
+	defer s.removeConn(sc)
 	for {
-		wg.Add(1)
 		// Parse the request
-		go func(wg *sync.WaitGroup) {
-			defer wg.Done()
-			rq, resp, err := s.ParseConnection(conn)
+		rq, resp, err := s.parseRequest(sc.conn(), sc.reader)
+		if err != nil {
+			if rq == nil {
+				// The connection was closed, or the stream can no longer be framed.
+				return
+			}
+			// The request was received, but could not be decoded
+			if errors.Is(err, ErrUnsupportedVersion) {
+				resp.SetError(STATUS_BAD_REQUEST, err.Error())
+				resp.Headers["ERROR_TYPE"] = ERROR_TYPE_VERSION
+			} else {
+				resp.SetError(STATUS_BAD_REQUEST, "request could not be decoded: "+err.Error())
+				resp.Headers["ERROR_TYPE"] = ERROR_TYPE_DECODE
+			}
+			err = s.sendTo(sc, resp)
 			if err != nil {
-				// LOGGER.Error(err)
 				return
 			}
+			continue
+		}
+		rq.ConnID = sc.ID
+		rq.WithContext(sc.Context())
+		if tls_conn, ok := conn.(*tls.Conn); ok {
+			// The handshake completed when the request was read
+			state := tls_conn.ConnectionState()
+			rq.TLS = &state
+		}
+		resp.conn_id = sc.ID
+		checkVaultBindings(rq, resp)
 
-			// Execute authentication
-			err = CONF.Default_Auth(rq, resp)
+		// Start the encrypted session
+		if rq.Headers["MESSAGE_TYPE"] == MESSAGE_TYPE_SECURE_HELLO {
+			err = s.secureHandshake(sc, rq, resp)
 			if err != nil {
-				// LOGGER.Error(err)
+				CONF.LOGGER.Error("error in secure handshake: " + err.Error())
 				return
 			}
+			continue
+		}
+		if s.Secure && sc.secure == nil {
+			resp.SetError(STATUS_FORBIDDEN, "the connection is not encrypted, start with a secure handshake")
+			err = s.sendTo(sc, resp)
+			if err != nil {
+				return
+			}
+			continue
+		}
 
-			// Handle middleware before response
-			s.MiddlewareBeforeResponse(rq, resp)
-
-			// Handle the request
-			s.ExecCallback(rq, resp)
+		// Answer the hello exchange
+		if rq.Headers["MESSAGE_TYPE"] == MESSAGE_TYPE_HELLO {
+			s.Hello(rq, resp)
+			err = s.sendTo(sc, resp)
+			if err != nil {
+				return
+			}
+			continue
+		}
 
-			// Handle middleware after response
-			s.MiddlewareAfterResponse(rq, resp)
+		// Hand the frames of open streams to their stream
+		if isStreamFrame(rq.Headers["MESSAGE_TYPE"]) {
+			stream, ok := sc.stream(rq.Headers["STREAM_ID"])
+			if ok {
+				stream.receive(&rq.Message)
+			}
+			continue
+		}
 
-			// LOGGER.Debug("Sending response")
-			err = s.Send(conn, resp)
+		// Execute authentication
+		err = CONF.Default_Auth(rq, resp)
+		if err != nil {
+			// Answer, so the client is not left waiting for the response
+			var status_err *StatusError
+			if errors.As(err, &status_err) {
+				resp.SetError(status_err.Status, status_err.Message)
+			} else {
+				resp.SetError(STATUS_UNAUTHORIZED, err.Error())
+			}
+			if rq.Headers["MESSAGE_TYPE"] == MESSAGE_TYPE_STREAM_OPEN {
+				refuseStream(sc, rq, resp)
+				continue
+			}
+			err = s.sendTo(sc, resp)
 			if err != nil {
 				return
 			}
-		}(wg)
-		wg.Wait()
+			continue
+		}
+
+		// Streams are handled in their own goroutine, so the connection keeps being read
+		if rq.Headers["MESSAGE_TYPE"] == MESSAGE_TYPE_STREAM_OPEN {
+			s.openStream(sc, rq)
+			continue
+		}
+
+		s.loadSession(rq, resp)
+
+		// Handle middleware before response
+		s.MiddlewareBeforeResponse(rq, resp)
+
+		// Handle the request
+		err = s.ExecCallback(rq, resp)
+		if err != nil && resp.ContentLength() == 0 {
+			// Nothing answered the request, not even middleware
+			resp.SetError(STATUS_NOT_FOUND, err.Error())
+		}
+
+		// Handle middleware after response
+		s.MiddlewareAfterResponse(rq, resp)
+
+		s.saveSession(rq, resp)
+
+		// Pick the content encoding and checksum the client accepts
+		s.NegotiateEncoding(rq, resp)
+		s.NegotiateChecksum(rq, resp)
+
+		// LOGGER.Debug("Sending response")
+		err = s.sendTo(sc, resp)
+		if err != nil {
+			return
+		}
 	}
 }
 
+func (s *Server) contentType() string {
+	if s.ContentType != "" {
+		return s.ContentType
+	}
+	return CONF.Content_Type
+}
+
 // Middleware to be used before the response is created
 func (s *Server) AddMiddlewareBeforeResp(middleware func(rq *Request, resp *Response)) {
 	Middleware := &Middleware{
@@ -156,19 +278,46 @@ func (s *Server) ExecCallback(rq *Request, resp *Response) error {
 	return nil
 }
 
+// Set the CONTENT_ENCODING of the response to one the client accepts,
+// unless one was already set by a callback.
+func (s *Server) NegotiateEncoding(rq *Request, resp *Response) {
+	if !CONF.Use_Compression {
+		return
+	}
+	if _, ok := resp.Headers["CONTENT_ENCODING"]; ok {
+		return
+	}
+	encoding, ok := NegotiateEncoding(rq.Headers["ACCEPT_ENCODING"])
+	if ok {
+		resp.Headers["CONTENT_ENCODING"] = encoding
+	}
+}
+
+// Set the CONTENT_CHECKSUM algorithm of the response to one the client accepts.
+func (s *Server) NegotiateChecksum(rq *Request, resp *Response) {
+	if _, ok := resp.Headers["CONTENT_CHECKSUM"]; ok {
+		return
+	}
+	algorithm, ok := NegotiateChecksum(rq.Headers["ACCEPT_CHECKSUM"])
+	if ok {
+		resp.Headers["CONTENT_CHECKSUM"] = algorithm
+	}
+}
+
 func (s *Server) Send(conn net.Conn, resp *Response) error {
-	if resp.Error != nil {
-		if len(resp.Error) > 0 {
-			resp = InitResponse()
-			resp.Headers["ERROR"] = "Internal Server Error"
-			err_resp := ""
-			for _, err := range resp.Error {
-				err_resp += err.Error() + "\n"
-			}
-			resp.Content = []byte(err_resp)
-		}
+	_, err := conn.Write(s.responseFrame(resp))
+	if err != nil {
+		err = errors.New("error sending response: " + err.Error())
+		CONF.LOGGER.Error(err.Error())
+		return err
 	}
-	_, err := conn.Write(resp.Bytes())
+	return nil
+}
+
+// Send a response over a connection of the server,
+// writes are serialized with pushes to the same connection.
+func (s *Server) sendTo(sc *ServerConn, resp *Response) error {
+	err := sc.Write(s.responseFrame(resp))
 	if err != nil {
 		err = errors.New("error sending response: " + err.Error())
 		CONF.LOGGER.Error(err.Error())
@@ -176,3 +325,31 @@ func (s *Server) Send(conn net.Conn, resp *Response) error {
 	}
 	return nil
 }
+
+// Generate the frame for a response, replacing it with an error response when errors were added,
+// or when it could not be encoded.
+func (s *Server) responseFrame(resp *Response) []byte {
+	if len(resp.Error) == 0 {
+		frame, err := resp.generate()
+		if err == nil {
+			return frame
+		}
+		// The client still needs an answer to its request
+		CONF.LOGGER.Error("error generating response: " + err.Error())
+		resp.AddError(err.Error())
+	}
+	err_resp := ""
+	for _, err := range resp.Error {
+		err_resp += err.Error() + "\n"
+	}
+	err_resp_headers := resp.Headers
+	resp = InitResponse()
+	resp.SetError(STATUS_INTERNAL_ERROR, err_resp)
+	// Keep what the client needs to match the response to its request
+	for _, key := range []string{"REQUEST_ID", "PROTO_VERSION"} {
+		if val, ok := err_resp_headers[key]; ok {
+			resp.Headers[key] = val
+		}
+	}
+	return resp.Generate()
+}
@@ -71,8 +71,7 @@ func Test_Requests(t *testing.T) {
 			err = errors.New("error closing client connection: " + err.Error())
 			t.Error(err)
 		}
-		_, ok := client.Cookies["TEST1"]
-		if ok {
+		if client.Cookies.GetCookie("TEST1") != nil {
 			t.Error("Cookie TEST1 was not deleted")
 		}
 	}(client)
@@ -233,12 +232,12 @@ func Test_Requests_LONG(t *testing.T) {
 		CONF.LOGGER.Test("(LONG) Response received, Content length: " + strconv.Itoa(respone.ContentLength()))
 		// CONF.LOGGER.Test("(LONG) SetValues: " + fmt.Sprintf("%v", respone.SetValues))
 		// CONF.LOGGER.Test("(LONG) Headers: " + fmt.Sprintf("%v", respone.Headers))
-		_, ok := client.Cookies["TEST1"]
+		ok := client.Cookies.GetCookie("TEST1") != nil
 		CONF.LOGGER.Test("(LONG) Testing cookie TEST1 found: " + strconv.FormatBool(ok) + "\n")
 		if ok {
 			t.Error("Cookie TEST1 was not deleted")
 		}
-		CONF.LOGGER.Test("(LONG) Cookies: " + fmt.Sprintf("%v", client.Cookies))
+		CONF.LOGGER.Test("(LONG) Cookies: " + fmt.Sprintf("%v", client.Cookies.All()))
 	}(client, wg)
 
 	// Wait for server to receive request
@@ -358,7 +357,7 @@ func Test_Requests_LONG(t *testing.T) {
 			t.Error(err.Error())
 		}
 		flag := false
-		for _, cookie := range client.Cookies {
+		for _, cookie := range client.Cookies.All() {
 			if cookie.Name == "VAULT-TEST_LOCK" {
 				flag = true
 				key, value, ok := CONF.GetVault(cookie.Value)
@@ -0,0 +1,334 @@
+package tcpproto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the cookie holding the session ID.
+const SESSION_COOKIE = "SESSION_ID"
+
+// Returned by a SessionStore for sessions which do not exist, or have expired.
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionStore keeps sessions on the server, only the session ID is sent to the client.
+type SessionStore interface {
+	// Load the session, ErrSessionNotFound if it does not exist or has expired.
+	Load(id string) (*Session, error)
+	Save(session *Session) error
+	Delete(id string) error
+}
+
+// Session holds values for a client between requests.
+type Session struct {
+	ID      string            `json:"id"`
+	Values  map[string]string `json:"values"`
+	Expires time.Time         `json:"expires"`
+	// ID the session was loaded with, when it has been regenerated
+	old_id    string
+	destroyed bool
+}
+
+func newSession() *Session {
+	return &Session{
+		ID:     newSessionID(),
+		Values: make(map[string]string),
+	}
+}
+
+func newSessionID() string {
+	id := make([]byte, 32)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func validSessionID(id string) bool {
+	if len(id) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (s *Session) Get(key string) (string, bool) {
+	value, ok := s.Values[key]
+	return value, ok
+}
+
+func (s *Session) Set(key string, value string) {
+	s.Values[key] = value
+}
+
+func (s *Session) Delete(key string) {
+	delete(s.Values, key)
+}
+
+func (s *Session) Expired() bool {
+	return !s.Expires.IsZero() && time.Now().After(s.Expires)
+}
+
+// Give the session a new ID, keeping its values.
+// Call this when the privileges of the client change, like after logging in.
+func (s *Session) Regenerate() {
+	if s.old_id == "" {
+		s.old_id = s.ID
+	}
+	s.ID = newSessionID()
+}
+
+// Remove the session from the store, and the session cookie from the client.
+func (s *Session) Destroy() {
+	s.destroyed = true
+	s.Values = make(map[string]string)
+}
+
+func copySession(session *Session) *Session {
+	values := make(map[string]string, len(session.Values))
+	for key, value := range session.Values {
+		values[key] = value
+	}
+	return &Session{
+		ID:      session.ID,
+		Values:  values,
+		Expires: session.Expires,
+	}
+}
+
+// MemorySessionStore keeps sessions in memory, they are lost when the server stops.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (m *MemorySessionStore) Load(id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if session.Expired() {
+		delete(m.sessions, id)
+		return nil, ErrSessionNotFound
+	}
+	return copySession(session), nil
+}
+
+func (m *MemorySessionStore) Save(session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[session.ID] = copySession(session)
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// Remove all expired sessions.
+func (m *MemorySessionStore) DeleteExpired() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, session := range m.sessions {
+		if session.Expired() {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// FileSessionStore keeps every session in a JSON file in a directory.
+type FileSessionStore struct {
+	Dir string
+}
+
+// Create the store, and the directory if it does not exist.
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{Dir: dir}, nil
+}
+
+func (f *FileSessionStore) path(id string) (string, error) {
+	if !validSessionID(id) {
+		return "", errors.New("invalid session id")
+	}
+	return filepath.Join(f.Dir, id+".json"), nil
+}
+
+func (f *FileSessionStore) Load(id string) (*Session, error) {
+	path, err := f.path(id)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	err = json.Unmarshal(data, session)
+	if err != nil {
+		return nil, err
+	}
+	if session.Expired() || session.ID != id {
+		os.Remove(path)
+		return nil, ErrSessionNotFound
+	}
+	if session.Values == nil {
+		session.Values = make(map[string]string)
+	}
+	return session, nil
+}
+
+func (f *FileSessionStore) Save(session *Session) error {
+	path, err := f.path(session.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a session is never read half written
+	tmp, err := os.CreateTemp(f.Dir, ".session-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *FileSessionStore) Delete(id string) error {
+	path, err := f.path(id)
+	if err != nil {
+		return nil
+	}
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Remove all expired sessions.
+func (f *FileSessionStore) DeleteExpired() error {
+	entries, err := os.ReadDir(f.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !validSessionID(id) {
+			continue
+		}
+		// Loading removes the session when it has expired
+		_, err := f.Load(id)
+		if err != nil && err != ErrSessionNotFound {
+			CONF.LOGGER.Error("error loading session " + id + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// The session of the client, created when it does not have one yet.
+// Changes are saved once the handler and middleware have run.
+// Returns nil when the server has no SessionStore.
+func (rq *Request) Session() *Session {
+	if rq.session != nil || rq.session_store == nil {
+		return rq.session
+	}
+	if rq.session_id != "" {
+		session, err := rq.session_store.Load(rq.session_id)
+		if err == nil {
+			rq.session = session
+			return session
+		}
+		if err != ErrSessionNotFound {
+			CONF.LOGGER.Error("error loading session: " + err.Error())
+		}
+	}
+	// Never take over an unknown ID from the client
+	rq.session = newSession()
+	return rq.session
+}
+
+// Prepare the session of the request, it is loaded when the handler asks for it.
+func (s *Server) loadSession(rq *Request, resp *Response) {
+	if s.Sessions == nil {
+		return
+	}
+	rq.session_store = s.Sessions
+	if cookie := rq.Cookie(SESSION_COOKIE); cookie != nil {
+		rq.session_id = cookie.Value
+		resp.session_id = cookie.Value
+	}
+}
+
+// Save the session of the request if it was used, and send its ID to the client.
+func (s *Server) saveSession(rq *Request, resp *Response) {
+	// Vault values bound to the session need one, also when the handler did not use it
+	if resp.session_id == "" && resp.bindsSession() && rq.Session() == nil {
+		resp.AddError("vault values are bound to the session, but the server has no SessionStore")
+		return
+	}
+	session := rq.session
+	if session == nil {
+		return
+	}
+	if session.old_id != "" {
+		err := rq.session_store.Delete(session.old_id)
+		if err != nil {
+			CONF.LOGGER.Error("error deleting session: " + err.Error())
+		}
+	}
+	if session.destroyed {
+		err := rq.session_store.Delete(session.ID)
+		if err != nil {
+			CONF.LOGGER.Error("error deleting session: " + err.Error())
+		}
+		delete(resp.SetValues, SESSION_COOKIE)
+		resp.Forget(SESSION_COOKIE)
+		resp.session_id = ""
+		return
+	}
+	if CONF.SESSION_TTL > 0 {
+		session.Expires = time.Now().Add(CONF.SESSION_TTL)
+	}
+	err := rq.session_store.Save(session)
+	if err != nil {
+		CONF.LOGGER.Error("error saving session: " + err.Error())
+		return
+	}
+	resp.Remember(SESSION_COOKIE, session.ID)
+	resp.session_id = session.ID
+}
@@ -0,0 +1,129 @@
+package tcpproto
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_SessionStores(t *testing.T) {
+	file_store, err := NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]SessionStore{
+		"memory": NewMemorySessionStore(),
+		"file":   file_store,
+	}
+	for name, store := range stores {
+		session := newSession()
+		session.Set("TEST", "VALUE")
+		session.Expires = time.Now().Add(time.Hour)
+		if err := store.Save(session); err != nil {
+			t.Fatal(name + ": error saving session: " + err.Error())
+		}
+		loaded, err := store.Load(session.ID)
+		if err != nil {
+			t.Fatal(name + ": error loading session: " + err.Error())
+		}
+		if value, _ := loaded.Get("TEST"); value != "VALUE" {
+			t.Error(name + ": session value was not stored")
+		}
+
+		if err := store.Delete(session.ID); err != nil {
+			t.Error(name + ": error deleting session: " + err.Error())
+		}
+		if _, err := store.Load(session.ID); err != ErrSessionNotFound {
+			t.Error(name + ": deleted session was loaded")
+		}
+
+		expired := newSession()
+		expired.Expires = time.Now().Add(-time.Second)
+		store.Save(expired)
+		if _, err := store.Load(expired.ID); err != ErrSessionNotFound {
+			t.Error(name + ": expired session was loaded")
+		}
+	}
+
+	if _, err := file_store.Load("../../etc/passwd"); err != ErrSessionNotFound {
+		t.Error("invalid session id was loaded")
+	}
+}
+
+func Test_Session(t *testing.T) {
+	testConfig(t, nil)
+	store := NewMemorySessionStore()
+	server := InitServer("127.0.0.1", 0, "")
+	server.Sessions = store
+	server.AddCallback("SET", func(rq *Request, resp *Response) {
+		rq.Session().Set("NAME", string(rq.Content))
+	})
+	server.AddCallback("GET", func(rq *Request, resp *Response) {
+		name, _ := rq.Session().Get("NAME")
+		resp.Content = []byte(name)
+	})
+	server.AddCallback("REGENERATE", func(rq *Request, resp *Response) {
+		rq.Session().Regenerate()
+	})
+	server.AddCallback("DESTROY", func(rq *Request, resp *Response) {
+		rq.Session().Destroy()
+	})
+	client := testConnect(t, server)
+	send := func(command string, content string) string {
+		rq := InitRequest(command)
+		rq.Content = []byte(content)
+		resp, err := client.Send(rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(resp.Content)
+	}
+	session_id := func() string {
+		if cookie := client.Cookies.GetCookie(SESSION_COOKIE); cookie != nil {
+			return cookie.Value
+		}
+		return ""
+	}
+
+	// The session ID is sent as a cookie, the values stay on the server
+	send("SET", "TEST")
+	id := session_id()
+	if id == "" {
+		t.Fatal("Session cookie was not issued")
+	}
+	if name := send("GET", ""); name != "TEST" {
+		t.Errorf("Session value was not kept: %q", name)
+	}
+
+	// A new ID keeps the values, the old one can no longer be used
+	send("REGENERATE", "")
+	if session_id() == id || session_id() == "" {
+		t.Errorf("Session ID was not regenerated: %q", session_id())
+	}
+	if _, err := store.Load(id); err != ErrSessionNotFound {
+		t.Error("Old session ID was not deleted")
+	}
+	if name := send("GET", ""); name != "TEST" {
+		t.Errorf("Session value was lost when regenerating: %q", name)
+	}
+
+	// The client is told to forget the destroyed session
+	id = session_id()
+	send("DESTROY", "")
+	if session_id() != "" {
+		t.Error("Session cookie was not forgotten")
+	}
+	if _, err := store.Load(id); err != ErrSessionNotFound {
+		t.Error("Destroyed session was not deleted")
+	}
+
+	// IDs the server did not issue are never taken over
+	forged := newSessionID()
+	client.Cookies.AddCookie(InitCookie(SESSION_COOKIE, forged))
+	send("SET", "FORGED")
+	if session_id() == forged {
+		t.Error("Unknown session ID was taken over")
+	}
+	if _, err := store.Load(forged); err != ErrSessionNotFound {
+		t.Error("Session was stored under an unknown ID")
+	}
+}
@@ -2,9 +2,8 @@ package tcpproto
 
 import (
 	"embed"
-	"encoding/base64"
 	"io/fs"
-	"strings"
+	"time"
 )
 
 //go:embed PUBKEY.pem
@@ -21,6 +20,40 @@ type Config struct {
 	MAX_CONTENT_LENGTH int
 	MAX_HEADER_SIZE    int
 	FS                 fs.FS
+	// Compress responses when the client sends ACCEPT_ENCODING,
+	// bodies smaller than COMPRESSION_MIN_SIZE are always sent raw.
+	Use_Compression      bool
+	COMPRESSION_MIN_SIZE int
+	// Checksum algorithm the client uses for request bodies and asks for on responses.
+	// Either "crc32c" or "sha256", empty disables checksums.
+	// Received checksums are always verified.
+	Checksum string
+	// Exchange a hello with the server when connecting,
+	// to agree on the protocol version and features.
+	Use_Handshake bool
+	// Content type used when neither the message, server or client set one
+	Content_Type string
+	// Pushes a client queues for its push handlers,
+	// pushes which arrive while the queue is full are dropped.
+	PUSH_BUFFER_SIZE int
+	// Published messages queued per subscriber,
+	// subscribers which fall further behind are disconnected.
+	PUBSUB_BUFFER_SIZE int
+	// Unread messages each side of a stream buffers,
+	// the other side waits with sending more until messages have been read.
+	STREAM_WINDOW int
+	// Size of the chunks files are uploaded and downloaded in
+	TRANSFER_CHUNK_SIZE int
+	// How long sessions are kept after the last request which used them,
+	// zero keeps them until they are destroyed.
+	SESSION_TTL time.Duration
+	// Read vault values encrypted with the padded secret key by older versions, disabled by default.
+	// They are encrypted with a derived key when the server sends them back,
+	// only enable this while the clients are migrated.
+	// Legacy values have no expiry or binding, so they are accepted for as long as this is enabled.
+	Vault_Legacy bool
+	// Secrets the vault is encrypted with, the secret key is used when it is nil or empty.
+	Vault_Keys *Keyring
 }
 
 func InitConfig(secret_key string, loglevel string, buff_size int, max_length int, use_crypto bool, include_sysinfo bool, fs fs.FS, authenticate func(rq *Request, resp *Response) error) *Config {
@@ -34,6 +67,15 @@ func InitConfig(secret_key string, loglevel string, buff_size int, max_length in
 		MAX_CONTENT_LENGTH: max_length,
 		MAX_HEADER_SIZE:    max_length,
 		FS:                 fs,
+
+		Use_Compression:      true,
+		COMPRESSION_MIN_SIZE: KILOBYTE,
+		Content_Type:         CONTENT_TYPE_JSON,
+		PUSH_BUFFER_SIZE:     256,
+		PUBSUB_BUFFER_SIZE:   256,
+		STREAM_WINDOW:        16,
+		TRANSFER_CHUNK_SIZE:  MEGABYTE,
+		SESSION_TTL:          24 * time.Hour,
 	}
 }
 
@@ -59,37 +101,3 @@ func GetConfig() *Config {
 func Authenticate(rq *Request, resp *Response) error {
 	return nil
 }
-
-func (c *Config) GenVault(key string, value string) (string, error) {
-	// Encrypt the value
-	enc_key := &[32]byte{}
-	copy(enc_key[:], []byte(PadStr(c.SecretKey, 32)))
-
-	encrypted, err := Encrypt([]byte(key+"%EQUALS%"+value), enc_key)
-	if err != nil {
-		c.LOGGER.Error(err.Error())
-		return "", err
-	}
-	b64 := base64.StdEncoding.EncodeToString(encrypted)
-	return b64, nil
-}
-
-func (c *Config) GetVault(value string) (string, string, bool) {
-	// Decrypt the value
-	decoded, err := base64.StdEncoding.DecodeString(value)
-	if err != nil {
-		c.LOGGER.Error(err.Error())
-		return "", "", false
-	}
-	enc_key := &[32]byte{}
-	copy(enc_key[:], []byte(PadStr(c.SecretKey, 32)))
-
-	decrypted, err := Decrypt(decoded, enc_key)
-	if err != nil {
-		c.LOGGER.Error(err.Error())
-		return "", "", false
-	}
-	// Split the key and value
-	split := strings.Split(string(decrypted), "%EQUALS%")
-	return split[0], split[1], true
-}
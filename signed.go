@@ -0,0 +1,103 @@
+package tcpproto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+)
+
+// Key the values are signed with, derived from a secret of the vault keyring,
+// so it differs from the keys the vault is encrypted with.
+func signingKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("tcpproto signed values"))
+	return mac.Sum(nil)
+}
+
+func signatureOf(secret string, key string, value string) []byte {
+	mac := hmac.New(sha256.New, signingKey(secret))
+	// The key is signed as well, so a value cannot be moved to another key.
+	// It is prefixed with its length, so the key and value cannot be told apart differently.
+	length := make([]byte, binary.MaxVarintLen64)
+	mac.Write(length[:binary.PutUvarint(length, uint64(len(key)))])
+	mac.Write([]byte(key))
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// Sign the value with the primary key of the vault keyring, the client can read it but not change it.
+// The ID of the key and the tag are appended to the value, separated by dots.
+func (c *Config) SignValue(key string, value string) string {
+	id, secret := c.primaryVaultKey()
+	return value + "." + id + "." + base64.RawURLEncoding.EncodeToString(signatureOf(secret, key, value))
+}
+
+// Check the tag of a signed value, returns the value without the key ID and tag if it matches.
+// Values signed with any key of the keyring are accepted.
+func (c *Config) VerifySigned(key string, signed string) (string, bool) {
+	index := strings.LastIndex(signed, ".")
+	if index < 0 {
+		return "", false
+	}
+	tag, err := base64.RawURLEncoding.DecodeString(signed[index+1:])
+	if err != nil {
+		return "", false
+	}
+	id_index := strings.LastIndex(signed[:index], ".")
+	if id_index < 0 {
+		return "", false
+	}
+	value, id := signed[:id_index], signed[id_index+1:index]
+	secret, ok := c.vaultSecret(id)
+	if !ok {
+		return "", false
+	}
+	if !hmac.Equal(tag, signatureOf(secret, key, value)) {
+		return "", false
+	}
+	return value, true
+}
+
+// Remember a value the client can read, but not change.
+// Values which were tampered with are not given to the handlers.
+func (resp *Response) RememberSigned(key string, value string) *Response {
+	resp.Signed[key] = value
+	return resp
+}
+
+func (resp *Response) GetSigned(key string) (string, bool) {
+	value, ok := resp.Signed[key]
+	return value, ok
+}
+
+func (resp *Response) ForgetSigned(key string) {
+	resp.DelValues = append(resp.DelValues, "SIGNED-"+key)
+}
+
+// Get a signed value the client sent, only values with a valid tag are returned.
+func (rq *Request) GetSigned(key string) (string, bool) {
+	value, ok := rq.Signed[key]
+	return value, ok
+}
+
+// Verify the signed values of the request.
+// Forged values are dropped, and the client is told to forget them.
+func TransferSigned(rq *Request, resp *Response) {
+	for header, signed := range rq.Headers {
+		if !strings.HasPrefix(header, "SIGNED-") {
+			continue
+		}
+		delete(rq.Headers, header)
+		key := strings.TrimPrefix(header, "SIGNED-")
+		value, ok := CONF.VerifySigned(key, signed)
+		if !ok {
+			CONF.LOGGER.Error("Signed value " + key + " has an invalid signature")
+			resp.ForgetSigned(key)
+			continue
+		}
+		rq.Signed[key] = value
+		resp.Signed[key] = value
+	}
+}
@@ -0,0 +1,61 @@
+package tcpproto
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_SignValue(t *testing.T) {
+	signed := CONF.SignValue("USER", "nigel.admin")
+	value, ok := CONF.VerifySigned("USER", signed)
+	if !ok || value != "nigel.admin" {
+		t.Errorf("Signed value was not verified: %s %v", value, ok)
+	}
+
+	forged := []string{
+		"root" + signed[len("nigel.admin"):],
+		signed[:len(signed)-1],
+		"nigel.admin",
+		"",
+	}
+	for _, value := range forged {
+		if _, ok := CONF.VerifySigned("USER", value); ok {
+			t.Errorf("Forged value was accepted: %s", value)
+		}
+	}
+	if _, ok := CONF.VerifySigned("OTHER", signed); ok {
+		t.Error("Signed value was accepted under another key")
+	}
+	// Part of the key cannot be moved into the value
+	moved := CONF.SignValue("USER%EQUALS%nigel", "admin")
+	if _, ok := CONF.VerifySigned("USER", "nigel%EQUALS%"+moved); ok {
+		t.Error("Signed value was accepted with part of the key moved into it")
+	}
+}
+
+func Test_SignValue_Keyring(t *testing.T) {
+	conf := InitConfig("SECRET_KEY", "ERROR", 2048, DISABLED, false, false, PEM, Authenticate)
+	old_signed := conf.SignValue("USER", "nigel")
+	if !strings.HasPrefix(old_signed, "nigel."+VAULT_DEFAULT_KEY+".") {
+		t.Errorf("Signed value is not tagged with the default key: %s", old_signed)
+	}
+
+	conf.Vault_Keys = NewKeyring()
+	conf.Vault_Keys.Add("2022", "NEW_SECRET_KEY")
+	signed := conf.SignValue("USER", "nigel")
+	if !strings.HasPrefix(signed, "nigel.2022.") {
+		t.Errorf("Signed value is not tagged with the primary key: %s", signed)
+	}
+	for _, value := range []string{old_signed, signed} {
+		if got, ok := conf.VerifySigned("USER", value); !ok || got != "nigel" {
+			t.Errorf("Signed value was not verified: %s", value)
+		}
+	}
+	// A tag made with one key is not valid for another
+	if _, ok := conf.VerifySigned("USER", strings.Replace(signed, ".2022.", "."+VAULT_DEFAULT_KEY+".", 1)); ok {
+		t.Error("Signed value was accepted with another key ID")
+	}
+	if _, ok := conf.VerifySigned("USER", strings.Replace(signed, ".2022.", ".2023.", 1)); ok {
+		t.Error("Signed value was accepted with an unknown key ID")
+	}
+}
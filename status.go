@@ -0,0 +1,118 @@
+package tcpproto
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Status codes sent in the STATUS header of a response.
+// Responses without a STATUS header are treated as STATUS_OK.
+const (
+	STATUS_OK                     = 200
+	STATUS_BAD_REQUEST            = 400
+	STATUS_UNAUTHORIZED           = 401
+	STATUS_FORBIDDEN              = 403
+	STATUS_NOT_FOUND              = 404
+	STATUS_CONFLICT               = 409
+	STATUS_UNSUPPORTED_MEDIA_TYPE = 415
+	STATUS_INTERNAL_ERROR         = 500
+)
+
+func StatusText(status int) string {
+	switch status {
+	case STATUS_OK:
+		return "OK"
+	case STATUS_BAD_REQUEST:
+		return "Bad Request"
+	case STATUS_UNAUTHORIZED:
+		return "Unauthorized"
+	case STATUS_FORBIDDEN:
+		return "Forbidden"
+	case STATUS_NOT_FOUND:
+		return "Not Found"
+	case STATUS_CONFLICT:
+		return "Conflict"
+	case STATUS_UNSUPPORTED_MEDIA_TYPE:
+		return "Unsupported Media Type"
+	case STATUS_INTERNAL_ERROR:
+		return "Internal Server Error"
+	}
+	return "Status " + strconv.Itoa(status)
+}
+
+// StatusError is an error with a status code.
+// Returned by the client for error responses,
+// and can be returned by handlers to choose the status sent to the client.
+type StatusError struct {
+	Status  int
+	Message string
+	// The fields which failed validation, for STATUS_BAD_REQUEST responses of typed handlers
+	Fields ValidationErrors
+}
+
+func NewStatusError(status int, message string) *StatusError {
+	return &StatusError{
+		Status:  status,
+		Message: message,
+	}
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return strconv.Itoa(e.Status) + " " + StatusText(e.Status)
+	}
+	return strconv.Itoa(e.Status) + " " + StatusText(e.Status) + ": " + e.Message
+}
+
+// Errors with the same status and message are equal,
+// so errors returned by the client can be compared to declared errors with errors.Is.
+func (e *StatusError) Is(target error) bool {
+	t, ok := target.(*StatusError)
+	if !ok {
+		return false
+	}
+	return e.Status == t.Status && e.Message == t.Message
+}
+
+func (resp *Response) SetStatus(status int) *Response {
+	resp.Headers["STATUS"] = strconv.Itoa(status)
+	return resp
+}
+
+// Status of the response, STATUS_OK if none was set.
+func (resp *Response) Status() int {
+	status, err := strconv.Atoi(resp.Headers["STATUS"])
+	if err != nil {
+		return STATUS_OK
+	}
+	return status
+}
+
+// Set an error status, the message is sent as the content of the response.
+func (resp *Response) SetError(status int, message string) *Response {
+	resp.SetStatus(status)
+	resp.Headers["ERROR"] = StatusText(status)
+	resp.Content = []byte(message)
+	return resp
+}
+
+// The error of the response as a *StatusError, nil if the response was successful.
+func (resp *Response) Err() error {
+	status := resp.Status()
+	_, has_error := resp.Headers["ERROR"]
+	if status < STATUS_BAD_REQUEST && !has_error {
+		return nil
+	}
+	if status < STATUS_BAD_REQUEST {
+		status = STATUS_INTERNAL_ERROR
+	}
+	err := NewStatusError(status, string(resp.Content))
+	if resp.Headers["ERROR_TYPE"] == ERROR_TYPE_VALIDATION {
+		var fields ValidationErrors
+		if json.Unmarshal(resp.Content, &fields) == nil {
+			err.Fields = fields
+			err.Message = fields.Error()
+		}
+	}
+	return err
+}
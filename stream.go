@@ -0,0 +1,508 @@
+package tcpproto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// Values of the MESSAGE_TYPE header for streams.
+// Every frame of a stream carries the STREAM_ID header.
+const (
+	// Opens a stream for the COMMAND, sent by the client
+	MESSAGE_TYPE_STREAM_OPEN = "STREAM_OPEN"
+	// A message on an open stream, sent by either side
+	MESSAGE_TYPE_STREAM = "STREAM"
+	// Grants the other side STREAM_WINDOW more messages
+	MESSAGE_TYPE_STREAM_WINDOW = "STREAM_WINDOW"
+	// The sender will not send any more messages,
+	// from the server it carries the STATUS of the handler.
+	MESSAGE_TYPE_STREAM_END = "STREAM_END"
+	// Aborts the stream in both directions
+	MESSAGE_TYPE_STREAM_CANCEL = "STREAM_CANCEL"
+)
+
+var (
+	ErrStreamCanceled = errors.New("stream canceled")
+	ErrStreamClosed   = errors.New("stream closed for sending")
+)
+
+func isStreamFrame(message_type string) bool {
+	switch message_type {
+	case MESSAGE_TYPE_STREAM, MESSAGE_TYPE_STREAM_WINDOW, MESSAGE_TYPE_STREAM_END, MESSAGE_TYPE_STREAM_CANCEL:
+		return true
+	}
+	return false
+}
+
+// Stream is a long-lived exchange of messages for a single command.
+//
+// Each side can have at most CONF.STREAM_WINDOW unread messages from the other,
+// Send blocks until the other side has read enough messages to make room.
+// Both sides end their half of the stream with CloseSend, or abort it with Cancel.
+type Stream struct {
+	ID      string
+	Command string
+	// Request which opened the stream, only set on the server.
+	Request      *Request
+	ctx          context.Context
+	cancel       context.CancelFunc
+	write        func(frame []byte) error
+	content_type string
+	incoming     chan *Message
+	window       int
+	mu           sync.Mutex
+	cond         *sync.Cond
+	credit       int
+	consumed     int
+	local_ended  bool
+	remote_ended bool
+	end_err      error
+	err          error
+	// Whether the other side ending the stream ends it in both directions,
+	// the case for clients, as the server's handler has returned.
+	end_closes bool
+	// Called once both sides ended, or the stream was aborted
+	onDone func()
+	done   bool
+}
+
+func newStream(parent context.Context, id string, command string, write func(frame []byte) error) *Stream {
+	ctx, cancel := context.WithCancel(parent)
+	window := CONF.STREAM_WINDOW
+	if window <= 0 {
+		window = 1
+	}
+	stream := &Stream{
+		ID:       id,
+		Command:  command,
+		ctx:      ctx,
+		cancel:   cancel,
+		write:    write,
+		incoming: make(chan *Message, window),
+		window:   window,
+	}
+	stream.cond = sync.NewCond(&stream.mu)
+	return stream
+}
+
+// Cancelled when the stream is aborted by either side, or the connection closes.
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// Send a message to the other side.
+// Blocks while the other side has a full window of unread messages.
+func (s *Stream) Send(msg *Message) error {
+	s.mu.Lock()
+	for s.credit == 0 && !s.local_ended && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		return err
+	}
+	if s.local_ended {
+		s.mu.Unlock()
+		return ErrStreamClosed
+	}
+	s.credit--
+	s.mu.Unlock()
+	return s.sendFrame(MESSAGE_TYPE_STREAM, msg)
+}
+
+// Encode v with the codec of the stream, and send it.
+func (s *Stream) SendValue(v any) error {
+	msg := NewMessage(nil)
+	msg.content_type = s.content_type
+	err := msg.Encode(v)
+	if err != nil {
+		return err
+	}
+	return s.Send(msg)
+}
+
+// Receive the next message from the other side.
+// Returns io.EOF after the other side ended the stream,
+// or the error the server's handler returned.
+func (s *Stream) Recv() (*Message, error) {
+	select {
+	case msg, ok := <-s.incoming:
+		if !ok {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.end_err != nil {
+				return nil, s.end_err
+			}
+			return nil, io.EOF
+		}
+		s.grant()
+		return msg, nil
+	case <-s.ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, s.ctx.Err()
+	}
+}
+
+// Receive the next message and decode it into v.
+func (s *Stream) RecvValue(v any) error {
+	msg, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	return msg.Decode(v)
+}
+
+// Tell the other side no more messages will be sent.
+// Messages can still be received until the other side ends the stream as well.
+func (s *Stream) CloseSend() error {
+	return s.end(nil)
+}
+
+// Abort the stream in both directions.
+func (s *Stream) Cancel() error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	err := s.sendFrame(MESSAGE_TYPE_STREAM_CANCEL, nil)
+	s.abort(ErrStreamCanceled)
+	return err
+}
+
+// End the sending half of the stream, msg holds the status for the other side.
+func (s *Stream) end(msg *Message) error {
+	s.mu.Lock()
+	if s.local_ended || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.local_ended = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	err := s.sendFrame(MESSAGE_TYPE_STREAM_END, msg)
+	s.checkDone()
+	return err
+}
+
+// Abort the stream locally with the error.
+func (s *Stream) abort(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.cancel()
+	s.finish()
+}
+
+// Abort the stream, and let the other side know why.
+func (s *Stream) fail(err error) {
+	resp := InitResponse()
+	resp.SetError(STATUS_BAD_REQUEST, err.Error())
+	s.sendFrame(MESSAGE_TYPE_STREAM_CANCEL, &resp.Message)
+	s.abort(err)
+}
+
+// Let the other side send more messages once half of the window has been read.
+func (s *Stream) grant() {
+	s.mu.Lock()
+	s.consumed++
+	if s.consumed < (s.window+1)/2 || s.remote_ended || s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	n := s.consumed
+	s.consumed = 0
+	s.mu.Unlock()
+	s.sendWindow(n)
+}
+
+func (s *Stream) sendWindow(n int) error {
+	msg := NewMessage(nil)
+	msg.Headers["STREAM_WINDOW"] = strconv.Itoa(n)
+	return s.sendFrame(MESSAGE_TYPE_STREAM_WINDOW, msg)
+}
+
+func (s *Stream) sendFrame(message_type string, msg *Message) error {
+	if msg == nil {
+		msg = NewMessage(nil)
+	}
+	msg.Headers["MESSAGE_TYPE"] = message_type
+	msg.Headers["STREAM_ID"] = s.ID
+	frame, err := msg.encode("")
+	if err != nil {
+		return err
+	}
+	return s.write(frame)
+}
+
+// Handle a frame the other side sent on this stream.
+func (s *Stream) receive(msg *Message) {
+	msg.content_type = s.content_type
+	switch msg.Headers["MESSAGE_TYPE"] {
+	case MESSAGE_TYPE_STREAM:
+		s.mu.Lock()
+		if s.remote_ended || s.err != nil {
+			s.mu.Unlock()
+			return
+		}
+		select {
+		case s.incoming <- msg:
+			s.mu.Unlock()
+		default:
+			s.mu.Unlock()
+			s.fail(errors.New("stream window exceeded"))
+		}
+	case MESSAGE_TYPE_STREAM_WINDOW:
+		n, err := strconv.Atoi(msg.Headers["STREAM_WINDOW"])
+		if err != nil || n <= 0 {
+			s.fail(errors.New("invalid stream window: " + msg.Headers["STREAM_WINDOW"]))
+			return
+		}
+		s.mu.Lock()
+		s.credit += n
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	case MESSAGE_TYPE_STREAM_END:
+		s.mu.Lock()
+		if s.remote_ended || s.err != nil {
+			s.mu.Unlock()
+			return
+		}
+		s.remote_ended = true
+		s.end_err = messageErr(msg)
+		close(s.incoming)
+		if s.end_closes {
+			s.local_ended = true
+			s.cond.Broadcast()
+		}
+		s.mu.Unlock()
+		s.checkDone()
+	case MESSAGE_TYPE_STREAM_CANCEL:
+		err := messageErr(msg)
+		if err == nil {
+			err = ErrStreamCanceled
+		}
+		s.abort(err)
+	}
+}
+
+func (s *Stream) checkDone() {
+	s.mu.Lock()
+	done := s.local_ended && s.remote_ended
+	s.mu.Unlock()
+	if done {
+		s.finish()
+	}
+}
+
+func (s *Stream) finish() {
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	onDone := s.onDone
+	s.mu.Unlock()
+	if onDone != nil {
+		onDone()
+	}
+}
+
+// The status error a stream frame carries, if any.
+func messageErr(msg *Message) error {
+	resp := InitResponse()
+	resp.Headers = msg.Headers
+	resp.Content = msg.Content
+	return resp.Err()
+}
+
+// Create a message with the content, to send on a stream.
+func NewMessage(content []byte) *Message {
+	msg := initMessage()
+	if content != nil {
+		msg.Content = content
+	}
+	return &msg
+}
+
+// Add a handler for streams opened for the COMMAND.
+// The stream ends when the handler returns, the error is sent to the client as the status.
+// Calling CloseSend in the handler ends the stream early with STATUS_OK.
+func (s *Server) AddStreamHandler(command string, handler func(stream *Stream) error) {
+	s.StreamHandlers[command] = handler
+}
+
+// Cancel a stream the client opened with the error response, before it was opened on the server.
+func refuseStream(sc *ServerConn, rq *Request, resp *Response) {
+	stream := newStream(rq.Context(), rq.Headers["STREAM_ID"], rq.Headers["COMMAND"], sc.Write)
+	stream.sendFrame(MESSAGE_TYPE_STREAM_CANCEL, &resp.Message)
+}
+
+// Start the handler for a stream the client opened.
+func (s *Server) openStream(sc *ServerConn, rq *Request) {
+	stream := newStream(rq.Context(), rq.Headers["STREAM_ID"], rq.Headers["COMMAND"], sc.Write)
+	stream.Request = rq
+	stream.content_type = rq.content_type
+	handler, ok := s.StreamHandlers[stream.Command]
+	if !ok || stream.ID == "" {
+		resp := InitResponse()
+		resp.SetError(STATUS_NOT_FOUND, "no stream handler for command: "+stream.Command)
+		refuseStream(sc, rq, resp)
+		return
+	}
+	credit, err := strconv.Atoi(rq.Headers["STREAM_WINDOW"])
+	if err != nil || credit <= 0 {
+		stream.fail(errors.New("invalid stream window: " + rq.Headers["STREAM_WINDOW"]))
+		return
+	}
+	stream.credit = credit
+	if !sc.addStream(stream) {
+		stream.fail(errors.New("stream already exists: " + stream.ID))
+		return
+	}
+	stream.sendWindow(stream.window)
+
+	go func() {
+		defer func() {
+			sc.removeStream(stream)
+			stream.cancel()
+		}()
+		err := handler(stream)
+		resp := InitResponse()
+		if err != nil {
+			writeHandlerError(resp, err)
+		} else {
+			resp.SetStatus(STATUS_OK)
+		}
+		stream.end(&resp.Message)
+	}()
+}
+
+func (sc *ServerConn) addStream(stream *Stream) bool {
+	sc.streams_mu.Lock()
+	defer sc.streams_mu.Unlock()
+	if sc.streams == nil {
+		sc.streams = make(map[string]*Stream)
+	}
+	if _, ok := sc.streams[stream.ID]; ok {
+		return false
+	}
+	sc.streams[stream.ID] = stream
+	return true
+}
+
+func (sc *ServerConn) removeStream(stream *Stream) {
+	sc.streams_mu.Lock()
+	defer sc.streams_mu.Unlock()
+	if sc.streams[stream.ID] == stream {
+		delete(sc.streams, stream.ID)
+	}
+}
+
+func (sc *ServerConn) stream(id string) (*Stream, bool) {
+	sc.streams_mu.Lock()
+	defer sc.streams_mu.Unlock()
+	stream, ok := sc.streams[id]
+	return stream, ok
+}
+
+// Abort every stream of the connection, it has been closed.
+func (sc *ServerConn) abortStreams() {
+	sc.streams_mu.Lock()
+	streams := make([]*Stream, 0, len(sc.streams))
+	for _, stream := range sc.streams {
+		streams = append(streams, stream)
+	}
+	sc.streams_mu.Unlock()
+	for _, stream := range streams {
+		stream.abort(io.ErrUnexpectedEOF)
+	}
+}
+
+// Open a stream for the command on the server.
+func (c *Client) OpenStream(command string) (*Stream, error) {
+	if !c.HasFeature(FEATURE_STREAM) {
+		return nil, errors.New("the server does not support streams")
+	}
+	c.startReading()
+	c.pending_mu.Lock()
+	if c.read_err != nil {
+		err := c.read_err
+		c.pending_mu.Unlock()
+		return nil, err
+	}
+	c.next_id++
+	id := "s" + strconv.FormatUint(c.next_id, 10)
+	stream := newStream(context.Background(), id, command, c.writeFrame)
+	stream.content_type = c.contentType()
+	stream.end_closes = true
+	stream.onDone = func() {
+		c.pending_mu.Lock()
+		delete(c.streams, id)
+		c.pending_mu.Unlock()
+	}
+	if c.streams == nil {
+		c.streams = make(map[string]*Stream)
+	}
+	c.streams[id] = stream
+	c.pending_mu.Unlock()
+
+	msg := NewMessage(nil)
+	msg.Headers["COMMAND"] = command
+	msg.Headers["STREAM_WINDOW"] = strconv.Itoa(stream.window)
+	if c.Version != 0 {
+		msg.Headers["PROTO_VERSION"] = strconv.Itoa(c.Version)
+	}
+	err := stream.sendFrame(MESSAGE_TYPE_STREAM_OPEN, msg)
+	if err != nil {
+		stream.abort(err)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Hand a frame from the server to its stream.
+func (c *Client) deliverStream(header map[string]string, recv_data []byte) {
+	c.pending_mu.Lock()
+	stream, ok := c.streams[header["STREAM_ID"]]
+	c.pending_mu.Unlock()
+	if !ok {
+		CONF.LOGGER.Debug("Received a frame for an unknown stream: " + header["STREAM_ID"])
+		return
+	}
+	msg := NewMessage(nil)
+	msg.Headers = header
+	msg.Content = recv_data
+	err := msg.decode()
+	if err != nil {
+		stream.fail(err)
+		return
+	}
+	stream.receive(msg)
+}
+
+// Abort every open stream, the connection can no longer be read.
+func (c *Client) abortStreams(err error) {
+	c.pending_mu.Lock()
+	streams := make([]*Stream, 0, len(c.streams))
+	for _, stream := range c.streams {
+		streams = append(streams, stream)
+	}
+	c.pending_mu.Unlock()
+	for _, stream := range streams {
+		stream.abort(err)
+	}
+}
@@ -0,0 +1,136 @@
+package tcpproto
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_Stream(t *testing.T) {
+	testConfig(t, func(conf *Config) {
+		conf.Use_Handshake, conf.STREAM_WINDOW = true, 2
+	})
+
+	sent := make(chan int, 10)
+	canceled := make(chan error, 1)
+	server := InitServer("127.0.0.1", 0, "")
+	server.AddStreamHandler("COUNT", func(stream *Stream) error {
+		for i := 0; i < 5; i++ {
+			if err := stream.Send(NewMessage([]byte(strconv.Itoa(i)))); err != nil {
+				return err
+			}
+			sent <- i
+		}
+		return nil
+	})
+	server.AddStreamHandler("ECHO", func(stream *Stream) error {
+		for {
+			msg, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	})
+	server.AddStreamHandler("WAIT", func(stream *Stream) error {
+		<-stream.Context().Done()
+		canceled <- stream.Context().Err()
+		return nil
+	})
+	server.AddStreamHandler("FAIL", func(stream *Stream) error {
+		return NewStatusError(STATUS_CONFLICT, "already running")
+	})
+	client := testConnect(t, server)
+
+	// The server only sends as many messages as the client has granted
+	stream, err := client.OpenStream("COUNT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(sent) != CONF.STREAM_WINDOW {
+		t.Errorf("Server sent %d messages with a window of %d", len(sent), CONF.STREAM_WINDOW)
+	}
+	for i := 0; i < 5; i++ {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Content) != strconv.Itoa(i) {
+			t.Errorf("Wrong message %d: %q", i, msg.Content)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Stream did not end: %v", err)
+	}
+
+	// The handler keeps receiving until the client closes its half
+	stream, err = client.OpenStream("ECHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := stream.Send(NewMessage([]byte("echo"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream.CloseSend()
+	if err := stream.Send(NewMessage(nil)); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("Sent after closing: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Content) != "echo" {
+			t.Errorf("Wrong echo: %q", msg.Content)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Echo stream did not end: %v", err)
+	}
+
+	// Cancelling aborts the handler
+	stream, err = client.OpenStream("WAIT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	stream.Cancel()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("Handler was not cancelled")
+	}
+	if _, err := stream.Recv(); !errors.Is(err, ErrStreamCanceled) {
+		t.Errorf("Cancelled stream returned: %v", err)
+	}
+
+	// Errors of the handler and unknown commands end the stream with their status
+	var status_err *StatusError
+	for command, status := range map[string]int{"FAIL": STATUS_CONFLICT, "UNKNOWN": STATUS_NOT_FOUND} {
+		stream, err = client.OpenStream(command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = stream.Recv()
+		if !errors.As(err, &status_err) || status_err.Status != status {
+			t.Errorf("Stream %s ended with: %v", command, err)
+		}
+	}
+
+	// Streams need the handshake
+	CONF.Use_Handshake = false
+	plain := connectTestClient(t, server, nil)
+	if _, err := plain.OpenStream("COUNT"); err == nil {
+		t.Error("Stream opened without a handshake")
+	}
+}
@@ -0,0 +1,85 @@
+package tcpproto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// Load a pool of CA certificates from PEM files,
+// to verify the server with on a client, or clients with on a server.
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + file)
+		}
+	}
+	return pool, nil
+}
+
+// TLS config for a server with the certificate and key in PEM files.
+// When clientCAs is not nil, clients must present a certificate signed by one of them.
+func NewServerTLSConfig(certFile string, keyFile string, clientCAs *x509.CertPool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// TLS config for a client, the server certificate is verified against rootCAs,
+// or the CAs of the system when it is nil.
+// When certFile is not empty, the client presents the certificate for mutual TLS.
+func NewClientTLSConfig(rootCAs *x509.CertPool, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		RootCAs:    rootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Start the server with TLS, using the certificate and key in PEM files.
+// Other settings, like the CAs to verify client certificates with, are taken from s.TLSConfig.
+func (s *Server) StartTLS(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	if s.TLSConfig == nil {
+		s.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	} else {
+		s.TLSConfig = s.TLSConfig.Clone()
+	}
+	s.TLSConfig.Certificates = append(s.TLSConfig.Certificates, cert)
+	return s.Start()
+}
+
+// The certificate the client presented, nil without TLS or when the client sent none.
+// When the server verifies client certificates, this certificate has been verified.
+func (rq *Request) PeerCertificate() *x509.Certificate {
+	if rq.TLS == nil || len(rq.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return rq.TLS.PeerCertificates[0]
+}
@@ -0,0 +1,113 @@
+package tcpproto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a certificate and its key to PEM files, signed by the parent, or self signed when it is nil.
+func writeTestCert(t *testing.T, dir string, name string, template *x509.Certificate, parent *x509.Certificate, parent_key *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parent_key = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parent_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func Test_TLS(t *testing.T) {
+	// TLS protects the whole connection, the client vault is not needed
+	testConfig(t, nil)
+	dir := t.TempDir()
+	ca, ca_key := writeTestCert(t, dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, ca_key)
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "agent-1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, ca_key)
+
+	pool, err := LoadCertPool(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := InitServer("127.0.0.1", 0, "")
+	server.TLSConfig, err = NewServerTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AddCallback("WHOAMI", func(rq *Request, resp *Response) {
+		if cert := rq.PeerCertificate(); cert != nil {
+			resp.Content = []byte(cert.Subject.CommonName)
+		}
+	})
+	startTestServer(t, server)
+
+	client_config, err := NewClientTLSConfig(pool, filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := connectTestClient(t, server, func(client *Client) {
+		client.TLSConfig = client_config
+	})
+	resp, err := client.Send(InitRequest("WHOAMI"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Content) != "agent-1" {
+		t.Errorf("Client certificate was not available: %q", resp.Content)
+	}
+
+	// Servers signed by another CA are not trusted
+	untrusted := InitClient(server.IP, server.Port, "")
+	untrusted.TLSConfig, _ = NewClientTLSConfig(x509.NewCertPool(), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+	if err := untrusted.Connect(); err == nil {
+		untrusted.Close()
+		t.Error("Server with an untrusted certificate was accepted")
+	}
+
+	// Clients without a certificate are refused
+	anonymous := InitClient(server.IP, server.Port, "")
+	anonymous.TLSConfig, _ = NewClientTLSConfig(pool, "", "")
+	if err := anonymous.Connect(); err == nil {
+		_, err = anonymous.Send(InitRequest("WHOAMI"))
+		anonymous.Close()
+		if err == nil {
+			t.Error("Client without a certificate was accepted")
+		}
+	}
+}
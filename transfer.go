@@ -0,0 +1,668 @@
+package tcpproto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Commands of the file transfer subsystem.
+const (
+	// Start or resume an upload, answered with the TRANSFER_ID and the confirmed TRANSFER_OFFSET
+	COMMAND_TRANSFER_START = "TRANSFER_START"
+	// Upload a chunk at TRANSFER_OFFSET, verified with CHUNK_CHECKSUM
+	COMMAND_TRANSFER_CHUNK = "TRANSFER_CHUNK"
+	// Move a completed upload to TRANSFER_NAME, replacing an existing file only with TRANSFER_OVERWRITE
+	COMMAND_TRANSFER_FINISH = "TRANSFER_FINISH"
+	// Remove an upload which will not be resumed
+	COMMAND_TRANSFER_ABORT = "TRANSFER_ABORT"
+	// Download the chunk of TRANSFER_NAME at TRANSFER_OFFSET
+	COMMAND_TRANSFER_READ = "TRANSFER_READ"
+)
+
+// WritableFS is a file system uploads are written to, and downloads are read from.
+type WritableFS interface {
+	fs.FS
+	// Open the file for writing, with the flags of os.OpenFile.
+	OpenFile(name string, flag int, perm fs.FileMode) (WritableFile, error)
+	Rename(oldname string, newname string) error
+	Remove(name string) error
+}
+
+// WritableFile is a file opened for writing, *os.File implements it.
+type WritableFile interface {
+	io.WriterAt
+	io.Closer
+	Stat() (fs.FileInfo, error)
+	Truncate(size int64) error
+}
+
+type dirFS string
+
+// A WritableFS for the files in the directory.
+func DirFS(dir string) WritableFS {
+	return dirFS(dir)
+}
+
+func (dir dirFS) path(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(string(dir), filepath.FromSlash(name)), nil
+}
+
+func (dir dirFS) Open(name string) (fs.File, error) {
+	path, err := dir.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (dir dirFS) OpenFile(name string, flag int, perm fs.FileMode) (WritableFile, error) {
+	path, err := dir.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (dir dirFS) Rename(oldname string, newname string) error {
+	oldpath, err := dir.path("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := dir.path("rename", newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+func (dir dirFS) Remove(name string) error {
+	path, err := dir.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// FileTransfer receives uploads into Dest, and serves downloads from it.
+//
+// Uploads are written to a partial file named after the transfer ID,
+// which is moved to its name when the upload is finished.
+// The confirmed offset is the size of the partial file, so uploads can be resumed after a restart of the server.
+// Transfer IDs are issued by the server, and carry a MAC made with the secret key,
+// so only IDs the server handed out are accepted.
+// Names with a part starting with a dot, like the partial files, cannot be uploaded or downloaded.
+type FileTransfer struct {
+	Dest WritableFS
+	// Largest chunk accepted or sent
+	ChunkSize int
+	locks     sync.Map
+}
+
+// Enable the TRANSFER_ commands on the server, writing uploads to dest.
+func (s *Server) EnableFileTransfer(dest WritableFS) *FileTransfer {
+	if s.FileTransfer != nil {
+		return s.FileTransfer
+	}
+	s.FileTransfer = &FileTransfer{
+		Dest:      dest,
+		ChunkSize: CONF.TRANSFER_CHUNK_SIZE,
+	}
+	s.AddCallback(COMMAND_TRANSFER_START, s.FileTransfer.handleStart)
+	s.AddCallback(COMMAND_TRANSFER_CHUNK, s.FileTransfer.handleChunk)
+	s.AddCallback(COMMAND_TRANSFER_FINISH, s.FileTransfer.handleFinish)
+	s.AddCallback(COMMAND_TRANSFER_ABORT, s.FileTransfer.handleAbort)
+	s.AddCallback(COMMAND_TRANSFER_READ, s.FileTransfer.handleRead)
+	return s.FileTransfer
+}
+
+func (ft *FileTransfer) chunkSize() int {
+	size := ft.ChunkSize
+	if size <= 0 {
+		size = CONF.TRANSFER_CHUNK_SIZE
+	}
+	if CONF.MAX_CONTENT_LENGTH > 0 && size > CONF.MAX_CONTENT_LENGTH {
+		size = CONF.MAX_CONTENT_LENGTH
+	}
+	return size
+}
+
+// Lock the transfer, so chunks of the same transfer are not written at the same time.
+func (ft *FileTransfer) lock(id string) func() {
+	mu, _ := ft.locks.LoadOrStore(id, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+func partName(id string) string {
+	return ".transfer-" + id + ".part"
+}
+
+// A random ID, followed by its MAC.
+func newTransferID() string {
+	random := randomID()
+	return random + transferMAC(random)
+}
+
+func transferMAC(random string) string {
+	mac := hmac.New(sha256.New, []byte(CONF.SecretKey))
+	mac.Write([]byte("tcpproto transfer " + random))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// Whether the ID was issued by this server.
+func validTransferID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(id[16:]), []byte(transferMAC(id[:16])))
+}
+
+// Names of files which can be uploaded and downloaded.
+// Hidden files, which include the partial uploads, are refused.
+func validTransferName(name string) bool {
+	if !fs.ValidPath(name) || name == "." {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// Refuse to replace an existing file, unless the client asked for it with TRANSFER_OVERWRITE.
+func (ft *FileTransfer) checkOverwrite(rq *Request, resp *Response, name string) bool {
+	if overwrite, _ := strconv.ParseBool(rq.Headers["TRANSFER_OVERWRITE"]); overwrite {
+		return true
+	}
+	_, err := fs.Stat(ft.Dest, name)
+	if err == nil {
+		resp.SetError(STATUS_CONFLICT, "file already exists: "+name)
+		return false
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+		return false
+	}
+	return true
+}
+
+// Parse a non-negative integer header.
+func parseSize(headers map[string]string, key string) (int64, error) {
+	size, err := strconv.ParseInt(headers[key], 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("invalid " + key + ": " + headers[key])
+	}
+	return size, nil
+}
+
+// The confirmed offset of an upload, creating the partial file if create is set.
+func (ft *FileTransfer) offset(id string, create bool) (int64, error) {
+	flag := os.O_WRONLY
+	if create {
+		flag |= os.O_CREATE | os.O_EXCL
+	}
+	file, err := ft.Dest.OpenFile(partName(id), flag, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (ft *FileTransfer) handleStart(rq *Request, resp *Response) {
+	name := rq.Headers["TRANSFER_NAME"]
+	if !validTransferName(name) {
+		resp.SetError(STATUS_BAD_REQUEST, "invalid TRANSFER_NAME: "+name)
+		return
+	}
+	size, err := parseSize(rq.Headers, "TRANSFER_SIZE")
+	if err != nil {
+		resp.SetError(STATUS_BAD_REQUEST, err.Error())
+		return
+	}
+	if !ft.checkOverwrite(rq, resp, name) {
+		return
+	}
+	// New uploads get an ID from the server, resumed uploads must have one
+	id, resume := rq.Headers["TRANSFER_ID"]
+	if !resume {
+		id = newTransferID()
+	} else if !validTransferID(id) {
+		resp.SetError(STATUS_BAD_REQUEST, "invalid TRANSFER_ID: "+id)
+		return
+	}
+	defer ft.lock(id)()
+	offset, err := ft.offset(id, !resume)
+	if resume && errors.Is(err, fs.ErrNotExist) {
+		resp.SetError(STATUS_NOT_FOUND, "transfer not found: "+id)
+		return
+	} else if err != nil {
+		resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+		return
+	}
+	if offset > size {
+		// Not the same file, start over
+		file, err := ft.Dest.OpenFile(partName(id), os.O_WRONLY, 0600)
+		if err == nil {
+			err = file.Truncate(0)
+			file.Close()
+		}
+		if err != nil {
+			resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+			return
+		}
+		offset = 0
+	}
+	resp.Headers["TRANSFER_ID"] = id
+	resp.Headers["TRANSFER_OFFSET"] = strconv.FormatInt(offset, 10)
+	resp.Headers["CHUNK_SIZE"] = strconv.Itoa(ft.chunkSize())
+}
+
+func (ft *FileTransfer) handleChunk(rq *Request, resp *Response) {
+	id := rq.Headers["TRANSFER_ID"]
+	if !validTransferID(id) {
+		resp.SetError(STATUS_BAD_REQUEST, "invalid TRANSFER_ID: "+id)
+		return
+	}
+	offset, err := parseSize(rq.Headers, "TRANSFER_OFFSET")
+	if err != nil {
+		resp.SetError(STATUS_BAD_REQUEST, err.Error())
+		return
+	}
+	if len(rq.Content) > ft.chunkSize() {
+		resp.SetError(STATUS_BAD_REQUEST, "chunk exceeds CHUNK_SIZE")
+		return
+	}
+	checksum, ok := rq.Headers["CHUNK_CHECKSUM"]
+	if !ok {
+		resp.SetError(STATUS_BAD_REQUEST, "CHUNK_CHECKSUM is required")
+		return
+	}
+	err = VerifyChecksum(checksum, rq.Content)
+	if err != nil {
+		resp.SetError(STATUS_BAD_REQUEST, err.Error())
+		return
+	}
+
+	defer ft.lock(id)()
+	file, err := ft.Dest.OpenFile(partName(id), os.O_WRONLY, 0600)
+	if errors.Is(err, fs.ErrNotExist) {
+		resp.SetError(STATUS_NOT_FOUND, "transfer not found: "+id)
+		return
+	} else if err != nil {
+		resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+		return
+	}
+	if info.Size() != offset {
+		// The client is out of sync, tell it where to continue
+		resp.SetError(STATUS_CONFLICT, "chunk is not at the confirmed offset")
+		resp.Headers["TRANSFER_OFFSET"] = strconv.FormatInt(info.Size(), 10)
+		return
+	}
+	_, err = file.WriteAt(rq.Content, offset)
+	if err != nil {
+		resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+		return
+	}
+	resp.Headers["TRANSFER_OFFSET"] = strconv.FormatInt(offset+int64(len(rq.Content)), 10)
+}
+
+func (ft *FileTransfer) handleFinish(rq *Request, resp *Response) {
+	id := rq.Headers["TRANSFER_ID"]
+	if !validTransferID(id) {
+		resp.SetError(STATUS_BAD_REQUEST, "invalid TRANSFER_ID: "+id)
+		return
+	}
+	name := rq.Headers["TRANSFER_NAME"]
+	if !validTransferName(name) {
+		resp.SetError(STATUS_BAD_REQUEST, "invalid TRANSFER_NAME: "+name)
+		return
+	}
+	size, err := parseSize(rq.Headers, "TRANSFER_SIZE")
+	if err != nil {
+		resp.SetError(STATUS_BAD_REQUEST, err.Error())
+		return
+	}
+
+	defer ft.lock(id)()
+	info, err := fs.Stat(ft.Dest, partName(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		resp.SetError(STATUS_NOT_FOUND, "transfer not found: "+id)
+		return
+	} else if err != nil {
+		resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+		return
+	}
+	if info.Size() != size {
+		resp.SetError(STATUS_CONFLICT, "transfer is incomplete")
+		resp.Headers["TRANSFER_OFFSET"] = strconv.FormatInt(info.Size(), 10)
+		return
+	}
+	if !ft.checkOverwrite(rq, resp, name) {
+		return
+	}
+	err = ft.Dest.Rename(partName(id), name)
+	if err != nil {
+		resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+		return
+	}
+	ft.locks.Delete(id)
+}
+
+func (ft *FileTransfer) handleAbort(rq *Request, resp *Response) {
+	id := rq.Headers["TRANSFER_ID"]
+	if !validTransferID(id) {
+		resp.SetError(STATUS_BAD_REQUEST, "invalid TRANSFER_ID: "+id)
+		return
+	}
+	defer ft.lock(id)()
+	err := ft.Dest.Remove(partName(id))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+		return
+	}
+	ft.locks.Delete(id)
+}
+
+func (ft *FileTransfer) handleRead(rq *Request, resp *Response) {
+	name := rq.Headers["TRANSFER_NAME"]
+	if !validTransferName(name) {
+		resp.SetError(STATUS_BAD_REQUEST, "invalid TRANSFER_NAME: "+name)
+		return
+	}
+	offset, err := parseSize(rq.Headers, "TRANSFER_OFFSET")
+	if err != nil {
+		resp.SetError(STATUS_BAD_REQUEST, err.Error())
+		return
+	}
+	chunk_size := ft.chunkSize()
+	if requested, err := strconv.Atoi(rq.Headers["CHUNK_SIZE"]); err == nil && requested > 0 && requested < chunk_size {
+		chunk_size = requested
+	}
+
+	file, err := ft.Dest.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		resp.SetError(STATUS_NOT_FOUND, "file not found: "+name)
+		return
+	} else if err != nil {
+		resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+		return
+	}
+	if info.IsDir() {
+		resp.SetError(STATUS_BAD_REQUEST, "not a file: "+name)
+		return
+	}
+	if offset > info.Size() {
+		resp.SetError(STATUS_BAD_REQUEST, "TRANSFER_OFFSET is past the end of the file")
+		return
+	}
+	chunk, err := readChunk(file, offset, chunk_size)
+	if err != nil {
+		resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+		return
+	}
+	checksum, err := Checksum(transferChecksum(), chunk)
+	if err != nil {
+		resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+		return
+	}
+	resp.Content = chunk
+	resp.Headers["CHUNK_CHECKSUM"] = checksum
+	resp.Headers["TRANSFER_OFFSET"] = strconv.FormatInt(offset, 10)
+	resp.Headers["TRANSFER_SIZE"] = strconv.FormatInt(info.Size(), 10)
+}
+
+// Read up to size bytes at the offset of the file.
+func readChunk(file fs.File, offset int64, size int) ([]byte, error) {
+	chunk := make([]byte, size)
+	var n int
+	var err error
+	switch f := file.(type) {
+	case io.ReaderAt:
+		n, err = f.ReadAt(chunk, offset)
+	case io.Seeker:
+		_, err = f.Seek(offset, io.SeekStart)
+		if err == nil {
+			n, err = io.ReadFull(file, chunk)
+		}
+	default:
+		_, err = io.CopyN(io.Discard, file, offset)
+		if err == nil {
+			n, err = io.ReadFull(file, chunk)
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return chunk[:n], err
+}
+
+// Checksum algorithm for chunks, CONF.Checksum if set.
+func transferChecksum() string {
+	if CONF.Checksum != "" {
+		return CONF.Checksum
+	}
+	return checksum_algorithms[0]
+}
+
+// Upload is the state of an upload, keep it to resume the upload after it was interrupted.
+type Upload struct {
+	// Assigned by the server when the upload starts
+	ID   string
+	Name string
+	Size int64
+	// Bytes the server has confirmed to have received
+	Offset int64
+	// Replace the file on the server if it already exists
+	Overwrite bool
+}
+
+func NewUpload(name string, size int64) *Upload {
+	return &Upload{
+		Name: name,
+		Size: size,
+	}
+}
+
+// Upload the data of r to the server, resuming the upload if it has an ID.
+// When resuming, r must be at the start of the data, or implement io.Seeker.
+// If the upload is interrupted, call Upload again with the same upload once reconnected.
+func (c *Client) Upload(upload *Upload, r io.Reader) error {
+	rq := InitRequest(COMMAND_TRANSFER_START)
+	rq.Headers["TRANSFER_NAME"] = upload.Name
+	rq.Headers["TRANSFER_SIZE"] = strconv.FormatInt(upload.Size, 10)
+	rq.Headers["TRANSFER_OVERWRITE"] = strconv.FormatBool(upload.Overwrite)
+	if upload.ID != "" {
+		rq.Headers["TRANSFER_ID"] = upload.ID
+	}
+	resp, err := c.sendTransfer(rq)
+	if err != nil {
+		return err
+	}
+	upload.ID = resp.Headers["TRANSFER_ID"]
+	upload.Offset, err = parseSize(resp.Headers, "TRANSFER_OFFSET")
+	if err != nil {
+		return err
+	}
+	chunk_size, err := strconv.Atoi(resp.Headers["CHUNK_SIZE"])
+	if err != nil || chunk_size <= 0 {
+		return errors.New("invalid CHUNK_SIZE: " + resp.Headers["CHUNK_SIZE"])
+	}
+	if requested := CONF.TRANSFER_CHUNK_SIZE; requested > 0 && requested < chunk_size {
+		chunk_size = requested
+	}
+
+	// Skip what the server already has
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err = seeker.Seek(upload.Offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, r, upload.Offset)
+	}
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, chunk_size)
+	for upload.Offset < upload.Size {
+		n := chunk_size
+		if remaining := upload.Size - upload.Offset; remaining < int64(n) {
+			n = int(remaining)
+		}
+		_, err = io.ReadFull(r, chunk[:n])
+		if err != nil {
+			return err
+		}
+		checksum, err := Checksum(transferChecksum(), chunk[:n])
+		if err != nil {
+			return err
+		}
+		rq := InitRequest(COMMAND_TRANSFER_CHUNK)
+		rq.Headers["TRANSFER_ID"] = upload.ID
+		rq.Headers["TRANSFER_OFFSET"] = strconv.FormatInt(upload.Offset, 10)
+		rq.Headers["CHUNK_CHECKSUM"] = checksum
+		rq.Content = chunk[:n]
+		resp, err := c.sendTransfer(rq)
+		if err != nil {
+			return err
+		}
+		offset, err := parseSize(resp.Headers, "TRANSFER_OFFSET")
+		if err != nil {
+			return err
+		}
+		if offset != upload.Offset+int64(n) {
+			return errors.New("server confirmed an unexpected offset: " + resp.Headers["TRANSFER_OFFSET"])
+		}
+		upload.Offset = offset
+	}
+
+	rq = InitRequest(COMMAND_TRANSFER_FINISH)
+	rq.Headers["TRANSFER_ID"] = upload.ID
+	rq.Headers["TRANSFER_NAME"] = upload.Name
+	rq.Headers["TRANSFER_SIZE"] = strconv.FormatInt(upload.Size, 10)
+	rq.Headers["TRANSFER_OVERWRITE"] = strconv.FormatBool(upload.Overwrite)
+	_, err = c.sendTransfer(rq)
+	return err
+}
+
+// Upload the file at path, the size of the upload is taken from the file if it is not set.
+func (c *Client) UploadFile(upload *Upload, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if upload.Size == 0 {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		upload.Size = info.Size()
+	}
+	return c.Upload(upload, file)
+}
+
+// Remove an upload from the server which will not be resumed.
+func (c *Client) AbortUpload(upload *Upload) error {
+	rq := InitRequest(COMMAND_TRANSFER_ABORT)
+	rq.Headers["TRANSFER_ID"] = upload.ID
+	_, err := c.sendTransfer(rq)
+	return err
+}
+
+// Download the file from the server into w, starting at the offset.
+// Returns the offset reached, pass it to Download again to resume an interrupted download.
+func (c *Client) Download(name string, w io.Writer, offset int64) (int64, error) {
+	for {
+		rq := InitRequest(COMMAND_TRANSFER_READ)
+		rq.Headers["TRANSFER_NAME"] = name
+		rq.Headers["TRANSFER_OFFSET"] = strconv.FormatInt(offset, 10)
+		rq.Headers["CHUNK_SIZE"] = strconv.Itoa(CONF.TRANSFER_CHUNK_SIZE)
+		resp, err := c.sendTransfer(rq)
+		if err != nil {
+			return offset, err
+		}
+		size, err := parseSize(resp.Headers, "TRANSFER_SIZE")
+		if err != nil {
+			return offset, err
+		}
+		err = VerifyChecksum(resp.Headers["CHUNK_CHECKSUM"], resp.Content)
+		if err != nil {
+			return offset, err
+		}
+		if len(resp.Content) == 0 && offset < size {
+			return offset, errors.New("server sent an empty chunk")
+		}
+		n, err := w.Write(resp.Content)
+		offset += int64(n)
+		if err != nil {
+			return offset, err
+		}
+		if offset >= size {
+			return offset, nil
+		}
+	}
+}
+
+// Download the file from the server to path.
+// An existing file at path is treated as an interrupted download, and resumed.
+func (c *Client) DownloadFile(name string, path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = c.Download(name, file, offset)
+	return err
+}
+
+func (c *Client) sendTransfer(rq *Request) (*Response, error) {
+	resp, err := c.Send(rq)
+	if err != nil {
+		return nil, err
+	}
+	err = resp.Err()
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
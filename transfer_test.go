@@ -0,0 +1,106 @@
+package tcpproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Fails after n bytes, like a connection which dropped.
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errors.New("interrupted")
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func Test_FileTransfer(t *testing.T) {
+	testConfig(t, func(conf *Config) { conf.TRANSFER_CHUNK_SIZE = 16 })
+	dir := t.TempDir()
+	server := InitServer("127.0.0.1", 0, "")
+	server.EnableFileTransfer(DirFS(dir))
+	client := testConnect(t, server)
+
+	// Interrupt the upload, and resume it
+	data := bytes.Repeat([]byte("TRANSFER_DATA\n"), 10)
+	upload := NewUpload("data.txt", int64(len(data)))
+	err := client.Upload(upload, &failingReader{r: bytes.NewReader(data), n: 40})
+	if err == nil {
+		t.Fatal("Interrupted upload did not fail")
+	}
+	if upload.ID == "" || upload.Offset != 32 {
+		t.Fatalf("Wrong upload state: %q %d", upload.ID, upload.Offset)
+	}
+
+	// Partial uploads cannot be downloaded
+	var buf bytes.Buffer
+	if _, err := client.Download(partName(upload.ID), &buf, 0); err == nil {
+		t.Error("Partial upload was downloaded")
+	}
+
+	err = client.Upload(upload, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("Uploaded file does not match: %v", err)
+	}
+
+	// Download in chunks, and resume from an offset
+	n, err := client.Download("data.txt", &buf, 0)
+	if err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Downloaded file does not match: %v", err)
+	}
+	buf.Reset()
+	_, err = client.Download("data.txt", &buf, 20)
+	if err != nil || !bytes.Equal(buf.Bytes(), data[20:]) {
+		t.Errorf("Resumed download does not match: %v", err)
+	}
+
+	var status_err *StatusError
+	// Existing files are only replaced when asked to
+	err = client.Upload(NewUpload("data.txt", 3), bytes.NewReader([]byte("new")))
+	if !errors.As(err, &status_err) || status_err.Status != STATUS_CONFLICT {
+		t.Errorf("Existing file was overwritten: %v", err)
+	}
+	overwrite := NewUpload("data.txt", 3)
+	overwrite.Overwrite = true
+	err = client.Upload(overwrite, bytes.NewReader([]byte("new")))
+	if err != nil {
+		t.Error(err)
+	}
+	if stored, _ := os.ReadFile(filepath.Join(dir, "data.txt")); string(stored) != "new" {
+		t.Errorf("File was not overwritten: %q", stored)
+	}
+
+	// Only IDs issued by the server are accepted
+	forged := NewUpload("forged.txt", 3)
+	forged.ID = "00"
+	err = client.Upload(forged, bytes.NewReader([]byte("bad")))
+	if !errors.As(err, &status_err) || status_err.Status != STATUS_BAD_REQUEST {
+		t.Errorf("Upload with a forged ID was accepted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, partName("00"))); err == nil {
+		t.Error("Partial file created for a forged ID")
+	}
+
+	// Hidden names are refused
+	err = client.Upload(NewUpload(".hidden", 3), bytes.NewReader([]byte("bad")))
+	if !errors.As(err, &status_err) || status_err.Status != STATUS_BAD_REQUEST {
+		t.Errorf("Upload to a hidden name was accepted: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package tcpproto
+
+import (
+	"context"
+	"errors"
+	"reflect"
+)
+
+// Register a typed handler for the command.
+// The request content is decoded into In with the codec for its CONTENT_TYPE,
+// falling back to the server's content type. Out is encoded with the same codec.
+// Requests which cannot be decoded are answered with STATUS_BAD_REQUEST,
+// and unknown content types with STATUS_UNSUPPORTED_MEDIA_TYPE.
+// Return a *StatusError from the handler to choose the status of the error response,
+// other errors are sent as STATUS_INTERNAL_ERROR.
+func Handle[In, Out any](srv *Server, command string, handler func(ctx context.Context, in In) (Out, error)) {
+	handle(srv, command, "", handler)
+}
+
+// Register a typed handler for the command, with JSON as the default content type.
+// See Handle.
+func HandleJSON[In, Out any](srv *Server, command string, handler func(ctx context.Context, in In) (Out, error)) {
+	handle(srv, command, CONTENT_TYPE_JSON, handler)
+}
+
+func handle[In, Out any](srv *Server, command string, content_type string, handler func(ctx context.Context, in In) (Out, error)) {
+	srv.AddCallback(command, func(rq *Request, resp *Response) {
+		if content_type != "" {
+			rq.content_type = content_type
+			if rq.Headers["CONTENT_TYPE"] == "" {
+				resp.content_type = content_type
+			}
+		}
+		var in In
+		// Handlers taking a pointer always get a value
+		if typ := reflect.TypeOf(&in).Elem(); typ.Kind() == reflect.Pointer {
+			in = reflect.New(typ.Elem()).Interface().(In)
+		}
+		if len(rq.Content) > 0 {
+			err := rq.Decode(&in)
+			if err != nil {
+				writeDecodeError(resp, err)
+				return
+			}
+		}
+		err := srv.Validate(&in)
+		if err != nil {
+			writeValidationError(resp, err)
+			return
+		}
+		out, err := handler(rq.Context(), in)
+		if err != nil {
+			writeHandlerError(resp, err)
+			return
+		}
+		err = resp.Encode(out)
+		if err != nil {
+			resp.SetError(STATUS_INTERNAL_ERROR, "invalid response content: "+err.Error())
+			return
+		}
+	})
+}
+
+// Call a command registered with Handle, in the content type of the client.
+// Error responses are returned as a *StatusError.
+func Call[In, Out any](client *Client, command string, in In) (Out, error) {
+	return call[In, Out](context.Background(), client, command, client.contentType(), in)
+}
+
+// Call a command registered with Handle, and stop waiting for the response when the context is done.
+// See Call.
+func CallContext[In, Out any](ctx context.Context, client *Client, command string, in In) (Out, error) {
+	return call[In, Out](ctx, client, command, client.contentType(), in)
+}
+
+// Call a command registered with HandleJSON.
+// Error responses are returned as a *StatusError.
+func CallJSON[In, Out any](client *Client, command string, in In) (Out, error) {
+	return call[In, Out](context.Background(), client, command, CONTENT_TYPE_JSON, in)
+}
+
+func call[In, Out any](ctx context.Context, client *Client, command string, content_type string, in In) (Out, error) {
+	var out Out
+	err := client.call(ctx, command, content_type, in, &out)
+	return out, err
+}
+
+func writeDecodeError(resp *Response, err error) {
+	if errors.Is(err, ErrUnsupportedContentType) {
+		resp.SetError(STATUS_UNSUPPORTED_MEDIA_TYPE, err.Error())
+		return
+	}
+	resp.SetError(STATUS_BAD_REQUEST, "invalid request content: "+err.Error())
+}
+
+func writeHandlerError(resp *Response, err error) {
+	var status_err *StatusError
+	if errors.As(err, &status_err) {
+		resp.SetError(status_err.Status, status_err.Message)
+		return
+	}
+	resp.SetError(STATUS_INTERNAL_ERROR, err.Error())
+}
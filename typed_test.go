@@ -0,0 +1,67 @@
+package tcpproto
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type typedGreeting struct {
+	Message string `json:"message"`
+}
+
+func Test_HandleJSON(t *testing.T) {
+	testConfig(t, nil)
+	server := InitServer("127.0.0.1", 0, "")
+	HandleJSON(server, "GREET", func(ctx context.Context, user *validateUser) (typedGreeting, error) {
+		if ctx.Err() != nil {
+			return typedGreeting{}, ctx.Err()
+		}
+		if user.Name == "NOBODY" {
+			return typedGreeting{}, NewStatusError(STATUS_NOT_FOUND, "unknown user")
+		}
+		return typedGreeting{Message: "Hello " + user.Name}, nil
+	})
+	HandleJSON(server, "SLOW", func(ctx context.Context, in int) (int, error) {
+		time.Sleep(100 * time.Millisecond)
+		return in, nil
+	})
+	client := testConnect(t, server)
+
+	user := &validateUser{Name: "TEST", Age: 30, Role: "user", Code: "AB", Address: validateAddress{City: "TEST"}}
+	greeting, err := CallJSON[*validateUser, typedGreeting](client, "GREET", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if greeting.Message != "Hello TEST" {
+		t.Error("Wrong response: " + greeting.Message)
+	}
+
+	// Errors of the handler keep their status
+	user.Name = "NOBODY"
+	_, err = CallJSON[*validateUser, typedGreeting](client, "GREET", user)
+	var status_err *StatusError
+	if !errors.As(err, &status_err) || status_err.Status != STATUS_NOT_FOUND {
+		t.Errorf("Handler error not returned: %v", err)
+	}
+
+	// Invalid input never reaches the handler
+	user.Name = "TE"
+	_, err = CallJSON[*validateUser, typedGreeting](client, "GREET", user)
+	if !errors.As(err, &status_err) || status_err.Status != STATUS_BAD_REQUEST || len(status_err.Fields) != 1 {
+		t.Errorf("Invalid input not refused: %v", err)
+	}
+
+	// Stop waiting when the context is done, the late response is not handed to the next call
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = CallContext[int, int](ctx, client, "SLOW", 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Call did not stop waiting: %v", err)
+	}
+	n, err := CallContext[int, int](context.Background(), client, "SLOW", 2)
+	if err != nil || n != 2 {
+		t.Errorf("Wrong response after a cancelled call: %d %v", n, err)
+	}
+}
@@ -0,0 +1,294 @@
+package tcpproto
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Validator is implemented by payloads which validate themselves.
+// Validate is called after the struct tags have been checked.
+// Return ValidationErrors to report failures for specific fields.
+type Validator interface {
+	Validate() error
+}
+
+// ValidationError is a single field which failed validation.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + " " + e.Message
+}
+
+// ValidationErrors lists every field which failed validation.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "validation failed: " + strings.Join(msgs, ", ")
+}
+
+// ERROR_TYPE header of responses with a JSON list of ValidationErrors as content.
+const ERROR_TYPE_VALIDATION = "VALIDATION"
+
+var regex_cache sync.Map
+
+// Validate v with its `validate` struct tags, and its Validate method if it has one.
+// Supported rules, separated by commas:
+//
+//	required      the value may not be the zero value
+//	min=N, max=N  bounds for numbers, or the length of strings, slices and maps
+//	enum=a|b|c    the value must be one of the options
+//	regex=EXPR    strings must match the expression, this must be the last rule
+//
+// Nested structs, pointers and slices of structs are validated as well.
+// Returns ValidationErrors when any field fails.
+func ValidateStruct(v any) error {
+	errs := make(ValidationErrors, 0)
+	value := reflect.ValueOf(v)
+	validateValue(value, "", &errs)
+	// Decoded payloads are passed as a pointer, possibly to another pointer
+	for value.Kind() == reflect.Pointer && !value.IsNil() && value.Elem().Kind() == reflect.Pointer {
+		value = value.Elem()
+	}
+	if value.IsValid() {
+		callValidate(value, "", &errs)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateValue(value reflect.Value, path string, errs *ValidationErrors) {
+	for value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.Struct:
+		typ := value.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := fieldName(field)
+			if path != "" {
+				name = path + "." + name
+			}
+			field_value := value.Field(i)
+			if tag, ok := field.Tag.Lookup("validate"); ok {
+				validateField(field_value, name, tag, errs)
+			}
+			validateValue(field_value, name, errs)
+			callValidate(field_value, name, errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			name := path + "[" + strconv.Itoa(i) + "]"
+			validateValue(value.Index(i), name, errs)
+			callValidate(value.Index(i), name, errs)
+		}
+	}
+}
+
+// Call the Validate method of a nested value, if it has one.
+func callValidate(value reflect.Value, path string, errs *ValidationErrors) {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+		if value.IsNil() {
+			return
+		}
+	}
+	if value.Kind() != reflect.Pointer && value.CanAddr() {
+		// Include methods with a pointer receiver
+		value = value.Addr()
+	}
+	if !value.CanInterface() {
+		return
+	}
+	if validator, ok := value.Interface().(Validator); ok {
+		appendValidateError(validator.Validate(), path, errs)
+	}
+}
+
+func appendValidateError(err error, path string, errs *ValidationErrors) {
+	if err == nil {
+		return
+	}
+	verrs, ok := err.(ValidationErrors)
+	if !ok {
+		*errs = append(*errs, &ValidationError{Field: path, Rule: "validate", Message: err.Error()})
+		return
+	}
+	for _, verr := range verrs {
+		field := verr.Field
+		if path != "" && field != "" {
+			field = path + "." + field
+		} else if path != "" {
+			field = path
+		}
+		*errs = append(*errs, &ValidationError{Field: field, Rule: verr.Rule, Message: verr.Message})
+	}
+}
+
+// Name of the field as the client sees it, the json name if it has one.
+func fieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+func validateField(value reflect.Value, name string, tag string, errs *ValidationErrors) {
+	fail := func(rule string, msg string) {
+		*errs = append(*errs, &ValidationError{Field: name, Rule: rule, Message: msg})
+	}
+	rules := tag
+	for rules != "" {
+		var rule string
+		if strings.HasPrefix(rules, "regex=") {
+			// The expression may contain commas
+			rule, rules = rules, ""
+		} else {
+			rule, rules, _ = strings.Cut(rules, ",")
+		}
+		rule = strings.TrimSpace(rule)
+		key, arg, _ := strings.Cut(rule, "=")
+		switch key {
+		case "":
+			continue
+		case "required":
+			if value.IsZero() {
+				fail(key, "is required")
+				return
+			}
+		case "min", "max":
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				fail(key, "has an invalid "+key+" rule: "+arg)
+				continue
+			}
+			n, is_length, ok := measure(value)
+			if !ok {
+				continue
+			}
+			if key == "min" && n < bound {
+				if is_length {
+					fail(key, "must have a length of at least "+arg)
+				} else {
+					fail(key, "must be at least "+arg)
+				}
+			}
+			if key == "max" && n > bound {
+				if is_length {
+					fail(key, "must have a length of at most "+arg)
+				} else {
+					fail(key, "must be at most "+arg)
+				}
+			}
+		case "enum":
+			options := strings.Split(arg, "|")
+			str := fmt.Sprint(indirect(value).Interface())
+			found := false
+			for _, option := range options {
+				if option == str {
+					found = true
+					break
+				}
+			}
+			if !found {
+				fail(key, "must be one of "+strings.Join(options, ", "))
+			}
+		case "regex":
+			v := indirect(value)
+			if v.Kind() != reflect.String {
+				continue
+			}
+			re, err := compileRegex(arg)
+			if err != nil {
+				fail(key, "has an invalid regex rule: "+err.Error())
+				continue
+			}
+			if !re.MatchString(v.String()) {
+				fail(key, "must match "+arg)
+			}
+		default:
+			fail(key, "has an unknown rule: "+key)
+		}
+	}
+}
+
+func indirect(value reflect.Value) reflect.Value {
+	for value.Kind() == reflect.Pointer && !value.IsNil() {
+		value = value.Elem()
+	}
+	return value
+}
+
+// The number to compare against min and max, and whether it is a length.
+func measure(value reflect.Value) (float64, bool, bool) {
+	value = indirect(value)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), false, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), false, true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), false, true
+	case reflect.String:
+		return float64(len([]rune(value.String()))), true, true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(value.Len()), true, true
+	}
+	return 0, false, false
+}
+
+func compileRegex(expr string) (*regexp.Regexp, error) {
+	if re, ok := regex_cache.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	regex_cache.Store(expr, re)
+	return re, nil
+}
+
+// Validate a decoded payload with the server's Validator, ValidateStruct if none was set.
+func (s *Server) Validate(v any) error {
+	if s.Validator != nil {
+		return s.Validator(v)
+	}
+	return ValidateStruct(v)
+}
+
+// Answer with STATUS_BAD_REQUEST, listing the fields which failed.
+func writeValidationError(resp *Response, err error) {
+	verrs, ok := err.(ValidationErrors)
+	if !ok {
+		verrs = ValidationErrors{&ValidationError{Rule: "validate", Message: err.Error()}}
+	}
+	content, _ := json.Marshal(verrs)
+	resp.SetError(STATUS_BAD_REQUEST, string(content))
+	resp.Headers["ERROR_TYPE"] = ERROR_TYPE_VALIDATION
+}
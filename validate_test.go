@@ -0,0 +1,57 @@
+package tcpproto
+
+import (
+	"errors"
+	"testing"
+)
+
+type validateAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+type validateUser struct {
+	Name    string            `json:"name" validate:"required,min=3,max=10"`
+	Age     int               `json:"age" validate:"min=18"`
+	Role    string            `json:"role" validate:"enum=admin|user"`
+	Code    string            `json:"code" validate:"regex=^[A-Z]{2,3}$"`
+	Address validateAddress   `json:"address"`
+	Friends []validateAddress `json:"friends"`
+}
+
+func (u *validateUser) Validate() error {
+	if u.Role == "admin" && u.Age < 21 {
+		return ValidationErrors{&ValidationError{Field: "role", Rule: "validate", Message: "requires an age of 21"}}
+	}
+	return nil
+}
+
+func Test_ValidateStruct(t *testing.T) {
+	valid := &validateUser{Name: "TEST", Age: 30, Role: "admin", Code: "AB", Address: validateAddress{City: "TEST"}}
+	if err := ValidateStruct(valid); err != nil {
+		t.Error("Valid struct failed validation: " + err.Error())
+	}
+
+	invalid := &validateUser{Name: "TE", Age: 18, Role: "admin", Code: "abc", Friends: []validateAddress{{}}}
+	err := ValidateStruct(invalid)
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatal("Invalid struct passed validation")
+	}
+	expected := map[string]string{
+		"name":            "min",
+		"code":            "regex",
+		"address.city":    "required",
+		"friends[0].city": "required",
+		"role":            "validate",
+	}
+	for _, verr := range errs {
+		rule, ok := expected[verr.Field]
+		if !ok || rule != verr.Rule {
+			t.Error("Unexpected validation error: " + verr.Field + " (" + verr.Rule + ")")
+		}
+		delete(expected, verr.Field)
+	}
+	for field := range expected {
+		t.Error("Missing validation error: " + field)
+	}
+}
@@ -0,0 +1,402 @@
+package tcpproto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of vault values encrypted with a key from the keyring,
+// followed by the key ID and the key of the value, which are authenticated with the encrypted payload.
+// The payload holds the value and its metadata.
+const VAULT_VERSION = "v4."
+
+// ID of the secret key of the config, used when the keyring has no keys.
+const VAULT_DEFAULT_KEY = "default"
+
+const vaultSaltSize = 16
+
+// Reasons a vault value sent by the client was dropped.
+var (
+	ErrVaultExpired    = errors.New("vault value has expired")
+	ErrVaultBinding    = errors.New("vault value is bound to another session or connection")
+	ErrVaultUnknownKey = errors.New("vault value was encrypted with an unknown key")
+	ErrVaultLegacy     = errors.New("vault value without version, legacy vault values are disabled")
+	ErrVaultInvalid    = errors.New("vault value could not be decrypted")
+	ErrVaultKey        = errors.New("vault value was sent under another key")
+)
+
+// What a vault value is bound to, the server only accepts it from there.
+type VaultBinding string
+
+const (
+	BIND_NONE VaultBinding = ""
+	// The session of the client, see Request.Session
+	BIND_SESSION VaultBinding = "session"
+	// The connection of the client, the value is dropped when the client reconnects
+	BIND_CONNECTION VaultBinding = "connection"
+)
+
+// VaultValue is a vault value with the metadata encrypted along with it.
+type VaultValue struct {
+	Key    string    `json:"key"`
+	Value  string    `json:"value"`
+	Issued time.Time `json:"issued"`
+	// Zero never expires
+	Expires time.Time    `json:"expires"`
+	Bind    VaultBinding `json:"bind,omitempty"`
+	// ID of the session or connection the value is bound to
+	BoundID string `json:"bound_id,omitempty"`
+}
+
+// Options for Response.LockWith
+type VaultOptions struct {
+	// How long the value is accepted, zero never expires
+	TTL  time.Duration
+	Bind VaultBinding
+}
+
+func (v *VaultValue) Expired() bool {
+	return !v.Expires.IsZero() && time.Now().After(v.Expires)
+}
+
+// Check the value is bound to the session or connection of the request.
+func (v *VaultValue) BoundTo(rq *Request) error {
+	switch v.Bind {
+	case BIND_NONE:
+		return nil
+	case BIND_SESSION:
+		cookie := rq.Cookie(SESSION_COOKIE)
+		if cookie != nil && cookie.Value == v.BoundID {
+			return nil
+		}
+	case BIND_CONNECTION:
+		if rq.ConnID != "" && rq.ConnID == v.BoundID {
+			return nil
+		}
+	}
+	return ErrVaultBinding
+}
+
+// Keyring holds the secrets the vault is encrypted with.
+// New values are encrypted with the primary key, values encrypted with the other keys can still be read.
+// To rotate keys, add the new key as primary, and remove the old key once clients have been sent their values again.
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[string]string
+	primary string
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys: make(map[string]string),
+	}
+}
+
+func validKeyID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Add a secret to the keyring, the first key added becomes the primary key.
+func (k *Keyring) Add(id string, secret string) error {
+	if !validKeyID(id) {
+		return errors.New("invalid key id: " + id)
+	}
+	if secret == "" {
+		return errors.New("empty secret for key " + id)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = secret
+	if k.primary == "" {
+		k.primary = id
+	}
+	return nil
+}
+
+// Encrypt new values with the key.
+func (k *Keyring) SetPrimary(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return errors.New("unknown key id: " + id)
+	}
+	k.primary = id
+	return nil
+}
+
+// Remove a key, values encrypted with it can no longer be read.
+// The primary key cannot be removed.
+func (k *Keyring) Remove(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id == k.primary {
+		return errors.New("cannot remove the primary key")
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+// The ID and secret of the primary key, false when the keyring is empty.
+func (k *Keyring) Primary() (string, string, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.primary == "" {
+		return "", "", false
+	}
+	return k.primary, k.keys[k.primary], true
+}
+
+func (k *Keyring) Get(id string) (string, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	secret, ok := k.keys[id]
+	return secret, ok
+}
+
+// The key new vault values are encrypted with.
+func (c *Config) primaryVaultKey() (string, string) {
+	if c.Vault_Keys != nil {
+		if id, secret, ok := c.Vault_Keys.Primary(); ok {
+			return id, secret
+		}
+	}
+	return VAULT_DEFAULT_KEY, c.SecretKey
+}
+
+// The secret for the key ID, the secret key of the config is used for VAULT_DEFAULT_KEY
+// unless the keyring holds a key with that ID.
+func (c *Config) vaultSecret(id string) (string, bool) {
+	if c.Vault_Keys != nil {
+		if secret, ok := c.Vault_Keys.Get(id); ok {
+			return secret, true
+		}
+	}
+	if id == VAULT_DEFAULT_KEY {
+		return c.SecretKey, true
+	}
+	return "", false
+}
+
+// Every value gets its own salt, so every value is encrypted with its own key.
+func vaultKey(secret string, salt []byte) *[32]byte {
+	return DeriveKey([]byte(secret), salt, "tcpproto vault")
+}
+
+// The key older versions encrypted the vault with.
+func (c *Config) legacyVaultKey() *[32]byte {
+	enc_key := &[32]byte{}
+	copy(enc_key[:], []byte(PadStr(c.SecretKey, 32)))
+	return enc_key
+}
+
+// Encrypt a vault value with the primary key.
+func (c *Config) GenVault(key string, value string) (string, error) {
+	return c.SealVault(&VaultValue{Key: key, Value: value})
+}
+
+// Encrypt a vault value and its metadata with the primary key.
+// The issued time is set to now when it is zero.
+func (c *Config) SealVault(v *VaultValue) (string, error) {
+	if v.Issued.IsZero() {
+		v.Issued = time.Now()
+	}
+	if v.Bind != BIND_NONE && v.BoundID == "" {
+		return "", errors.New("vault value " + v.Key + " is not bound to a " + string(v.Bind))
+	}
+	salt := make([]byte, vaultSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		c.LOGGER.Error(err.Error())
+		return "", err
+	}
+	id, secret := c.primaryVaultKey()
+	// The key is readable, like the name of the header, but cannot be changed
+	prefix := VAULT_VERSION + id + "." + base64.RawURLEncoding.EncodeToString([]byte(v.Key)) + "."
+	// Encrypt the value
+	encrypted, err := EncryptWithAAD(encodeVaultValue(v), vaultKey(secret, salt), []byte(prefix))
+	if err != nil {
+		c.LOGGER.Error(err.Error())
+		return "", err
+	}
+	b64 := base64.StdEncoding.EncodeToString(append(salt, encrypted...))
+	return prefix + b64, nil
+}
+
+// The metadata and value, every field is prefixed with its length,
+// so any value is read back exactly as it was written.
+func encodeVaultValue(v *VaultValue) []byte {
+	buf := make([]byte, 16, 16+len(v.Value)+len(v.Bind)+len(v.BoundID)+3*binary.MaxVarintLen64)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(unixNano(v.Issued)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(unixNano(v.Expires)))
+	length := make([]byte, binary.MaxVarintLen64)
+	for _, field := range []string{v.Value, string(v.Bind), v.BoundID} {
+		n := binary.PutUvarint(length, uint64(len(field)))
+		buf = append(buf, length[:n]...)
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+func decodeVaultValue(key string, data []byte) (*VaultValue, error) {
+	if len(data) < 16 {
+		return nil, ErrVaultInvalid
+	}
+	v := &VaultValue{
+		Key:     key,
+		Issued:  fromUnixNano(int64(binary.BigEndian.Uint64(data[0:8]))),
+		Expires: fromUnixNano(int64(binary.BigEndian.Uint64(data[8:16]))),
+	}
+	data = data[16:]
+	fields := make([]string, 3)
+	for i := range fields {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return nil, ErrVaultInvalid
+		}
+		fields[i] = string(data[n : n+int(length)])
+		data = data[n+int(length):]
+	}
+	if len(data) != 0 {
+		return nil, ErrVaultInvalid
+	}
+	v.Value, v.Bind, v.BoundID = fields[0], VaultBinding(fields[1]), fields[2]
+	return v, nil
+}
+
+// Zero for the zero time, which is out of range of UnixNano.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Decrypt a vault value with the key it was encrypted with.
+// Values which have expired, or are bound to a session or connection, are rejected,
+// use OpenVault to check the binding.
+func (c *Config) GetVault(value string) (string, string, bool) {
+	v, err := c.OpenVault(value)
+	if err != nil {
+		c.LOGGER.Error(err.Error())
+		return "", "", false
+	}
+	if v.Bind != BIND_NONE {
+		c.LOGGER.Error("vault value " + v.Key + " is bound to a " + string(v.Bind))
+		return "", "", false
+	}
+	return v.Key, v.Value, true
+}
+
+// Decrypt a vault value and its metadata, with the key it was encrypted with.
+// Expired values are rejected with ErrVaultExpired, the binding is not checked.
+func (c *Config) OpenVault(value string) (*VaultValue, error) {
+	var enc_key *[32]byte
+	var aad []byte
+	secret := ""
+	version := ""
+	key := ""
+	switch {
+	case strings.HasPrefix(value, VAULT_VERSION):
+		parts := strings.SplitN(strings.TrimPrefix(value, VAULT_VERSION), ".", 3)
+		if len(parts) != 3 {
+			return nil, ErrVaultInvalid
+		}
+		decoded_key, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, ErrVaultInvalid
+		}
+		version, key = VAULT_VERSION, string(decoded_key)
+		aad = []byte(VAULT_VERSION + parts[0] + "." + parts[1] + ".")
+		var ok bool
+		secret, ok = c.vaultSecret(parts[0])
+		if !ok {
+			return nil, ErrVaultUnknownKey
+		}
+		value = parts[2]
+	case c.Vault_Legacy:
+		// Values without a version were encrypted with the padded secret key
+		enc_key = c.legacyVaultKey()
+	default:
+		return nil, ErrVaultLegacy
+	}
+	// Decrypt the value
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrVaultInvalid
+	}
+	if enc_key == nil {
+		if len(decoded) < vaultSaltSize {
+			return nil, ErrVaultInvalid
+		}
+		enc_key = vaultKey(secret, decoded[:vaultSaltSize])
+		decoded = decoded[vaultSaltSize:]
+	}
+
+	decrypted, err := DecryptWithAAD(decoded, enc_key, aad)
+	if err != nil {
+		return nil, ErrVaultInvalid
+	}
+	var v *VaultValue
+	switch version {
+	case VAULT_VERSION:
+		v, err = decodeVaultValue(key, decrypted)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		// Legacy values only hold the key and value
+		key, value, ok := strings.Cut(string(decrypted), "%EQUALS%")
+		if !ok {
+			return nil, ErrVaultInvalid
+		}
+		v = &VaultValue{Key: key, Value: value}
+	}
+	if v.Expired() {
+		return nil, ErrVaultExpired
+	}
+	return v, nil
+}
+
+// Why the vault value with the key was dropped, nil if it was not.
+func (rq *Request) VaultError(key string) error {
+	return rq.VaultErrors[key]
+}
+
+func (rq *Request) dropVault(resp *Response, key string, err error) {
+	delete(rq.Vault, key)
+	delete(resp.Vault, key)
+	delete(resp.vault_meta, key)
+	rq.VaultErrors[key] = err
+	resp.ForgetVault(key)
+}
+
+// Drop the vault values of the request which are bound to another session or connection.
+func checkVaultBindings(rq *Request, resp *Response) {
+	for key, v := range resp.vault_meta {
+		err := v.BoundTo(rq)
+		if err != nil {
+			CONF.LOGGER.Error("Vault value VAULT-" + key + " dropped: " + err.Error())
+			rq.dropVault(resp, key, err)
+		}
+	}
+}
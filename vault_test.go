@@ -0,0 +1,207 @@
+package tcpproto
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Vault(t *testing.T) {
+	conf := InitConfig("SECRET_KEY", "ERROR", 2048, DISABLED, false, false, PEM, Authenticate)
+	vault, err := conf.GenVault("KEY", "VALUE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(vault, VAULT_VERSION) {
+		t.Errorf("Vault value has no version: %s", vault)
+	}
+	key, value, ok := conf.GetVault(vault)
+	if !ok || key != "KEY" || value != "VALUE" {
+		t.Errorf("Vault value was not decrypted: %s %s %v", key, value, ok)
+	}
+
+	// Values encrypted with the padded secret key are only read during the migration
+	legacy, _ := Encrypt([]byte("KEY%EQUALS%VALUE"), conf.legacyVaultKey())
+	legacy_vault := base64.StdEncoding.EncodeToString(legacy)
+	if _, err := conf.OpenVault(legacy_vault); err != ErrVaultLegacy {
+		t.Errorf("Legacy vault value was read by default: %v", err)
+	}
+	conf.Vault_Legacy = true
+	key, value, ok = conf.GetVault(legacy_vault)
+	if !ok || key != "KEY" || value != "VALUE" {
+		t.Errorf("Legacy vault value was not decrypted: %s %s %v", key, value, ok)
+	}
+	conf.Vault_Legacy = false
+
+	other := InitConfig("OTHER_KEY", "ERROR", 2048, DISABLED, false, false, PEM, Authenticate)
+	if _, _, ok := other.GetVault(vault); ok {
+		t.Error("Vault value was decrypted with another secret key")
+	}
+}
+
+func Test_Vault_Keyring(t *testing.T) {
+	conf := InitConfig("SECRET_KEY", "ERROR", 2048, DISABLED, false, false, PEM, Authenticate)
+	old_vault, _ := conf.GenVault("KEY", "OLD")
+	if !strings.HasPrefix(old_vault, VAULT_VERSION+VAULT_DEFAULT_KEY+".") {
+		t.Errorf("Vault value is not tagged with the default key: %s", old_vault)
+	}
+
+	conf.Vault_Keys = NewKeyring()
+	conf.Vault_Keys.Add("2022", "NEW_SECRET_KEY")
+	vault, _ := conf.GenVault("KEY", "NEW")
+	if !strings.HasPrefix(vault, VAULT_VERSION+"2022.") {
+		t.Errorf("Vault value is not tagged with the primary key: %s", vault)
+	}
+	// Both values can be read, the secret key is still the default key
+	for want, value := range map[string]string{"OLD": old_vault, "NEW": vault} {
+		if _, got, ok := conf.GetVault(value); !ok || got != want {
+			t.Errorf("Vault value was not decrypted: %s %v", got, ok)
+		}
+	}
+
+	// Once the default key is in the keyring and removed, the old value can no longer be read
+	conf.Vault_Keys.Add(VAULT_DEFAULT_KEY, "OTHER_SECRET")
+	if _, _, ok := conf.GetVault(old_vault); ok {
+		t.Error("Vault value was decrypted with the wrong key")
+	}
+	conf.Vault_Keys.Remove(VAULT_DEFAULT_KEY)
+	if err := conf.Vault_Keys.Remove("2022"); err == nil {
+		t.Error("Primary key was removed")
+	}
+	if err := conf.Vault_Keys.Add("bad.id", "SECRET"); err == nil {
+		t.Error("Key ID with a dot was accepted")
+	}
+}
+
+func Test_Vault_Metadata(t *testing.T) {
+	conf := InitConfig("SECRET_KEY", "ERROR", 2048, DISABLED, false, false, PEM, Authenticate)
+	expired, _ := conf.SealVault(&VaultValue{Key: "KEY", Value: "VALUE", Expires: time.Now().Add(-time.Second)})
+	if _, err := conf.OpenVault(expired); err != ErrVaultExpired {
+		t.Errorf("Expired vault value was not rejected: %v", err)
+	}
+
+	issued := time.Now().Add(-time.Hour).Round(time.Second)
+	bound, _ := conf.SealVault(&VaultValue{Key: "KEY", Value: "VALUE", Issued: issued, Bind: BIND_CONNECTION, BoundID: "CONN1"})
+	v, err := conf.OpenVault(bound)
+	if err != nil || !v.Issued.Equal(issued) {
+		t.Fatalf("Vault metadata was not kept: %v %+v", err, v)
+	}
+	rq := InitRequest()
+	rq.ConnID = "CONN2"
+	if err := v.BoundTo(rq); err != ErrVaultBinding {
+		t.Errorf("Vault value was accepted from another connection: %v", err)
+	}
+	rq.ConnID = "CONN1"
+	if err := v.BoundTo(rq); err != nil {
+		t.Errorf("Vault value was not accepted from its connection: %v", err)
+	}
+	// Bound values cannot be checked without the request
+	if _, _, ok := conf.GetVault(bound); ok {
+		t.Error("Bound vault value was returned by GetVault")
+	}
+	if _, err := conf.SealVault(&VaultValue{Key: "KEY", Bind: BIND_SESSION}); err == nil {
+		t.Error("Vault value bound to no session was sealed")
+	}
+}
+
+func Test_Vault_Encoding(t *testing.T) {
+	conf := InitConfig("SECRET_KEY", "ERROR", 2048, DISABLED, false, false, PEM, Authenticate)
+	values := []string{"", "%EQUALS%", "a%EQUALS%b%EQUALS%", "line\r\nbreak:.", "\xff\xfe\x00invalid utf-8", strings.Repeat("x", 4096)}
+	for _, value := range values {
+		vault, err := conf.GenVault("KEY.%EQUALS%", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, got, ok := conf.GetVault(vault)
+		if !ok || key != "KEY.%EQUALS%" || got != value {
+			t.Errorf("Vault value did not round-trip: %q %q %v", key, got, ok)
+		}
+	}
+
+	// The key is authenticated, it cannot be changed
+	vault, _ := conf.GenVault("USER", "VALUE")
+	parts := strings.SplitN(vault, ".", 4)
+	moved := strings.Join([]string{parts[0], parts[1], base64.RawURLEncoding.EncodeToString([]byte("ADMIN")), parts[3]}, ".")
+	if _, err := conf.OpenVault(moved); err != ErrVaultInvalid {
+		t.Errorf("Vault value with a changed key was accepted: %v", err)
+	}
+
+	malformed := []string{
+		"", ".", "v4.", "v4..", "v4.default..", "v4.default.!!.AAAA", "v3.default.", "v1.",
+		vault[:len(vault)-4], vault + "AAAA", "%EQUALS%",
+	}
+	conf.Vault_Legacy = true
+	for _, value := range malformed {
+		if _, err := conf.OpenVault(value); err == nil {
+			t.Errorf("Malformed vault value was accepted: %q", value)
+		}
+	}
+	for _, data := range [][]byte{nil, make([]byte, 16), append(make([]byte, 16), 0xff, 0xff), append(make([]byte, 16), 5, 'a')} {
+		if _, err := decodeVaultValue("KEY", data); err != ErrVaultInvalid {
+			t.Errorf("Malformed vault payload was accepted: %v", data)
+		}
+	}
+}
+
+func Test_Vault_Bindings(t *testing.T) {
+	testConfig(t, nil)
+	lock := func(rq *Request, resp *Response) {
+		resp.LockWith("SESSION_TOKEN", "session", VaultOptions{Bind: BIND_SESSION})
+		resp.LockWith("CONN_TOKEN", "conn", VaultOptions{Bind: BIND_CONNECTION})
+	}
+	server := InitServer("127.0.0.1", 0, "")
+	server.Sessions = NewMemorySessionStore()
+	server.AddCallback("LOCK", lock)
+	server.AddCallback("READ", func(rq *Request, resp *Response) {
+		resp.Content = []byte(rq.Vault["SESSION_TOKEN"] + "," + rq.Vault["CONN_TOKEN"])
+	})
+	client := testConnect(t, server)
+	read := func(client *Client) string {
+		resp, err := client.Send(InitRequest("READ"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(resp.Content)
+	}
+
+	// The handler did not use the session, one is started for the value bound to it
+	resp, err := client.Send(InitRequest("LOCK"))
+	if err != nil || resp.Status() != STATUS_OK {
+		t.Fatalf("Bound vault values were not locked: %v %q", err, resp.Content)
+	}
+	if client.Cookies.GetCookie(SESSION_COOKIE) == nil {
+		t.Fatal("No session was started for the value bound to it")
+	}
+	if content := read(client); content != "session,conn" {
+		t.Errorf("Bound vault values were not read back: %q", content)
+	}
+
+	// Values bound to the connection are dropped when the client reconnects
+	client.Close()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if content := read(client); content != "session," {
+		t.Errorf("Vault values after reconnecting: %q", content)
+	}
+
+	// Values copied to another client are dropped
+	other := connectTestClient(t, server, nil)
+	for _, name := range []string{"VAULT-SESSION_TOKEN", "VAULT-CONN_TOKEN"} {
+		if cookie := client.Cookies.GetCookie(name); cookie != nil {
+			other.Cookies.AddCookie(InitCookie(name, cookie.Value))
+		}
+	}
+	if content := read(other); content != "," {
+		t.Errorf("Copied vault values were accepted: %q", content)
+	}
+
+	// Without a session store the value cannot be bound, the handler is told so
+	plain := InitServer("127.0.0.1", 0, "")
+	plain.AddCallback("LOCK", lock)
+	resp, err = testConnect(t, plain).Send(InitRequest("LOCK"))
+	if err != nil || resp.Status() != STATUS_INTERNAL_ERROR {
+		t.Errorf("Value bound to a session was locked without sessions: %v %d", err, resp.Status())
+	}
+}
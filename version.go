@@ -0,0 +1,212 @@
+package tcpproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version of the protocol sent in the PROTO_VERSION header.
+const PROTO_VERSION = 1
+
+// All protocol versions this package can speak, newest first.
+var PROTO_VERSIONS = []int{PROTO_VERSION}
+
+// Features which can be advertised in the hello exchange.
+const (
+	FEATURE_COMPRESSION = "compression"
+	FEATURE_CHECKSUM    = "checksum"
+	FEATURE_PUSH        = "push"
+	FEATURE_STREAM      = "stream"
+	// Several requests and streams in flight on one connection, matched by REQUEST_ID and STREAM_ID.
+	FEATURE_MULTIPLEX = "multiplex"
+	// Frames with binary headers, not implemented, frames always have text headers.
+	FEATURE_BINARY_FRAMING = "binary-framing"
+)
+
+// Features of the protocol this package does not implement.
+// They are declined explicitly in the hello exchange.
+var DECLINED_FEATURES = []string{FEATURE_BINARY_FRAMING}
+
+// Values of the MESSAGE_TYPE header.
+// Messages without one are requests or responses.
+const (
+	MESSAGE_TYPE_HELLO = "HELLO"
+	MESSAGE_TYPE_PUSH  = "PUSH"
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrNoCommonVersion    = errors.New("no common protocol version")
+)
+
+// ERROR_TYPE header of responses to requests with a PROTO_VERSION the server does not support.
+const ERROR_TYPE_VERSION = "VERSION"
+
+// Verify the PROTO_VERSION header of a message.
+// Messages without the header are from before versioning, and treated as version 1.
+func CheckVersion(version string) error {
+	if version == "" {
+		return nil
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnsupportedVersion, version)
+	}
+	for _, supported := range PROTO_VERSIONS {
+		if v == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedVersion, version)
+}
+
+func joinVersions(versions []int) string {
+	strs := make([]string, len(versions))
+	for i, v := range versions {
+		strs[i] = strconv.Itoa(v)
+	}
+	return strings.Join(strs, ",")
+}
+
+func splitVersions(header string) []int {
+	versions := make([]int, 0)
+	for _, str := range strings.Split(header, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(str))
+		if err == nil {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+func splitFeatures(header string) []string {
+	features := make([]string, 0)
+	for _, feature := range strings.Split(header, ",") {
+		feature = strings.TrimSpace(feature)
+		if feature != "" {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// Pick the highest version both sides support.
+func NegotiateVersion(ours []int, theirs []int) (int, error) {
+	best := 0
+	for _, v := range ours {
+		for _, t := range theirs {
+			if v == t && v > best {
+				best = v
+			}
+		}
+	}
+	if best == 0 {
+		return 0, fmt.Errorf("%w: ours %s, theirs %s", ErrNoCommonVersion, joinVersions(ours), joinVersions(theirs))
+	}
+	return best, nil
+}
+
+// Features both sides support.
+func NegotiateFeatures(ours []string, theirs []string) []string {
+	common := make([]string, 0)
+	for _, feature := range ours {
+		for _, t := range theirs {
+			if feature == t {
+				common = append(common, feature)
+				break
+			}
+		}
+	}
+	return common
+}
+
+// Features supported with the current configuration.
+func Features() []string {
+	features := []string{FEATURE_CHECKSUM, FEATURE_PUSH, FEATURE_STREAM, FEATURE_MULTIPLEX}
+	if CONF.Use_Compression {
+		features = append(features, FEATURE_COMPRESSION)
+	}
+	return features
+}
+
+func containsFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Features which are not in ours, declined features are always included.
+func declinedFeatures(ours []string, theirs []string) []string {
+	declined := append([]string{}, DECLINED_FEATURES...)
+	for _, feature := range theirs {
+		if !containsFeature(ours, feature) && !containsFeature(declined, feature) {
+			declined = append(declined, feature)
+		}
+	}
+	return declined
+}
+
+// Answer a hello from the client with the versions and features the server supports.
+// Features the client asked for which the server does not support are listed in DECLINED.
+func (s *Server) Hello(rq *Request, resp *Response) {
+	features := s.Features()
+	resp.Headers["MESSAGE_TYPE"] = MESSAGE_TYPE_HELLO
+	resp.Headers["VERSIONS"] = joinVersions(PROTO_VERSIONS)
+	resp.Headers["FEATURES"] = strings.Join(features, ",")
+	resp.Headers["DECLINED"] = strings.Join(declinedFeatures(features, splitFeatures(rq.Headers["FEATURES"])), ",")
+}
+
+// Features this server advertises in the hello exchange.
+func (s *Server) Features() []string {
+	return Features()
+}
+
+// Send a hello to the server, and pick the best version and features both sides support.
+// Servers which do not know the hello exchange are assumed to speak version 1 without features.
+func (c *Client) Handshake() error {
+	rq := InitRequest()
+	rq.Headers["MESSAGE_TYPE"] = MESSAGE_TYPE_HELLO
+	rq.Headers["VERSIONS"] = joinVersions(PROTO_VERSIONS)
+	rq.Headers["FEATURES"] = strings.Join(Features(), ",")
+	header, recv_data, err := c.roundTrip(context.Background(), rq)
+	if err != nil {
+		return err
+	}
+	resp := InitResponse()
+	resp.Headers = header
+	resp.Content = recv_data
+	err = resp.decode()
+	if err != nil {
+		return err
+	}
+
+	versions := []int{1}
+	features := []string{}
+	declined := []string{}
+	if resp.Headers["MESSAGE_TYPE"] == MESSAGE_TYPE_HELLO {
+		versions = splitVersions(resp.Headers["VERSIONS"])
+		features = splitFeatures(resp.Headers["FEATURES"])
+		declined = splitFeatures(resp.Headers["DECLINED"])
+	}
+	version, err := NegotiateVersion(PROTO_VERSIONS, versions)
+	if err != nil {
+		CONF.LOGGER.Error(err.Error())
+		return err
+	}
+	c.Version = version
+	c.Features = NegotiateFeatures(Features(), features)
+	c.Declined = declined
+	return nil
+}
+
+// Whether the feature was agreed upon in the handshake.
+// Without a handshake no feature is used.
+func (c *Client) HasFeature(feature string) bool {
+	return containsFeature(c.Features, feature)
+}
@@ -0,0 +1,81 @@
+package tcpproto
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func Test_CheckVersion(t *testing.T) {
+	for version, ok := range map[string]bool{"": true, "1": true, "2": false, "v1": false} {
+		err := CheckVersion(version)
+		if ok && err != nil {
+			t.Errorf("Version %q rejected: %v", version, err)
+		}
+		if !ok && !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("Version %q accepted", version)
+		}
+	}
+	if v, err := NegotiateVersion([]int{1, 2}, []int{3, 2, 1}); err != nil || v != 2 {
+		t.Errorf("Wrong version negotiated: %d %v", v, err)
+	}
+	if _, err := NegotiateVersion([]int{1}, []int{2}); !errors.Is(err, ErrNoCommonVersion) {
+		t.Error("Versions without overlap were accepted")
+	}
+}
+
+func Test_Hello(t *testing.T) {
+	testConfig(t, nil)
+	server := InitServer("127.0.0.1", 0, "")
+	rq := InitRequest()
+	rq.Headers["MESSAGE_TYPE"] = MESSAGE_TYPE_HELLO
+	rq.Headers["FEATURES"] = "multiplex,teleport"
+	resp := InitResponse()
+	server.Hello(rq, resp)
+	if resp.Headers["VERSIONS"] != "1" {
+		t.Error("Wrong versions advertised: " + resp.Headers["VERSIONS"])
+	}
+	features := splitFeatures(resp.Headers["FEATURES"])
+	if !containsFeature(features, FEATURE_MULTIPLEX) || containsFeature(features, FEATURE_BINARY_FRAMING) {
+		t.Error("Wrong features advertised: " + resp.Headers["FEATURES"])
+	}
+	declined := splitFeatures(resp.Headers["DECLINED"])
+	if !containsFeature(declined, "teleport") || !containsFeature(declined, FEATURE_BINARY_FRAMING) || containsFeature(declined, FEATURE_MULTIPLEX) {
+		t.Error("Wrong features declined: " + resp.Headers["DECLINED"])
+	}
+
+	client := testConnect(t, server)
+	if client.HasFeature(FEATURE_CHECKSUM) {
+		t.Error("Feature used without a handshake")
+	}
+	err := client.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Version != PROTO_VERSION {
+		t.Errorf("Wrong version agreed upon: %d", client.Version)
+	}
+	if !client.HasFeature(FEATURE_MULTIPLEX) || !client.HasFeature(FEATURE_STREAM) {
+		t.Error("Features not agreed upon: " + strings.Join(client.Features, ","))
+	}
+	if client.HasFeature(FEATURE_BINARY_FRAMING) || !containsFeature(client.Declined, FEATURE_BINARY_FRAMING) {
+		t.Error("Binary framing was not declined: " + strings.Join(client.Declined, ","))
+	}
+}
+
+func Test_UnsupportedVersion(t *testing.T) {
+	testConfig(t, nil)
+	server := InitServer("127.0.0.1", 0, "")
+	server.AddCallback("TEST", func(rq *Request, resp *Response) {})
+	client := testConnect(t, server)
+
+	rq := InitRequest("TEST")
+	rq.Headers["PROTO_VERSION"] = "2"
+	resp, err := client.Send(rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status() != STATUS_BAD_REQUEST || resp.Headers["ERROR_TYPE"] != ERROR_TYPE_VERSION {
+		t.Errorf("Unsupported version was not refused: %d %s %q", resp.Status(), resp.Headers["ERROR_TYPE"], resp.Content)
+	}
+}